@@ -1,18 +1,30 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"compress/zlib"
+	"container/list"
+	"context"
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 // all object types
@@ -30,12 +42,25 @@ var objTypeNames = map[byte]string{
 	OBJ_COMMIT:    "commit",
 	OBJ_TREE:      "tree",
 	OBJ_BLOB:      "blob",
+	OBJ_OFS_DELTA: "ofs_delta",
 	OBJ_REF_DELTA: "ref_delta",
 }
 
-type Delta struct {
-	hash string
-	data []byte
+// PackObject is one entry decoded from a packfile. Non-delta entries carry
+// their resolved content and objType right away; ofs/ref-delta entries
+// carry payload (the raw source-size/target-size/instruction stream) and
+// are filled in with content/objType/hash once resolveDeltaObjects resolves
+// them against their base.
+type PackObject struct {
+	offset     int64
+	packType   byte
+	objType    string
+	content    []byte
+	payload    []byte
+	baseOffset int64
+	baseHash   string
+	hash       string
+	crc32      uint32
 }
 
 const (
@@ -50,353 +75,1197 @@ type Instruction struct {
 	data     []byte
 }
 
-func getMainHash(repoURL string) (string, string, error) {
-	refsURL := fmt.Sprintf("%s/info/refs?service=git-upload-pack", repoURL)
+// UploadPackOptions carries the optional extensions to a git-upload-pack
+// request beyond the plain wants/haves list.
+type UploadPackOptions struct {
+	Depth int // shallow-clone depth; 0 means a full clone.
+}
+
+// Transport abstracts the git pack-protocol transport so getMainHash and
+// getPackfile don't need to know whether they're talking to a smart-HTTP
+// server or an SSH one.
+type Transport interface {
+	// AdvertisedRefs returns the server's initial ref advertisement: refs
+	// maps full ref name (e.g. "refs/heads/main") to its sha1, and
+	// capabilities are the capability strings announced alongside it,
+	// including symref=HEAD:refs/heads/<branch>.
+	AdvertisedRefs(ctx context.Context) (refs map[string]string, capabilities []string, err error)
+
+	// UploadPack runs git-upload-pack with the given wants/haves and opts
+	// and returns the raw upload-pack response body, ready for
+	// parseUploadPackResponse.
+	UploadPack(ctx context.Context, wants, haves []string, opts UploadPackOptions) (io.ReadCloser, error)
+}
 
-	resp, err := http.Get(refsURL)
+// getMainHash asks t for its ref advertisement and resolves the branch
+// HEAD points at (via the symref capability) to that branch's commit hash.
+func getMainHash(t Transport) (string, string, error) {
+	refs, capabilities, err := t.AdvertisedRefs(context.Background())
 	if err != nil {
-		return "", "", fmt.Errorf("failed to perform GET request to %s: %w",
-			refsURL, err)
+		return "", "", err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= 400 {
-		return "", "", fmt.Errorf("unexpected status code %d while fetching %s",
-			resp.StatusCode, refsURL)
+	const symrefPrefix = "symref=HEAD:refs/heads/"
+	defaultBranch := ""
+	for _, capability := range capabilities {
+		if strings.HasPrefix(capability, symrefPrefix) {
+			defaultBranch = strings.TrimPrefix(capability, symrefPrefix)
+			break
+		}
+	}
+	if defaultBranch == "" {
+		return "", "", fmt.Errorf("default branch not advertised by server")
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to read response body from %s: %w",
-			refsURL, err)
+	hash, ok := refs["refs/heads/"+defaultBranch]
+	if !ok {
+		return "", "", fmt.Errorf("refs/heads/%s not found in advertised refs", defaultBranch)
 	}
+	return hash, defaultBranch, nil
+}
 
-	defaultBranch := ""
-	lines := strings.Split(string(body), "\n")
-	for _, line := range lines {
-		if defaultBranch == "" {
-			words := strings.Split(line, " ")
-			for _, w := range words {
-				if strings.Contains(w, "HEAD:refs/heads") {
-					parts := strings.Split(w, "/")
-					if len(parts) >= 3 {
-						defaultBranch = parts[2]
-					}
-				}
-			}
+// buildUploadPackRequest frames a git-upload-pack request body: a want line
+// per entry in wants (capabilities are only advertised on the first), an
+// optional deepen line for opts.Depth, a have line per entry in haves, and
+// the trailing flush+done. gclone only ever clones into a fresh directory
+// (never fetches into one with existing history), so haves is always empty
+// today, but UploadPack's signature stays honest about what
+// git-upload-pack accepts.
+func buildUploadPackRequest(wants, haves []string, opts UploadPackOptions) string {
+	var b strings.Builder
+	for i, want := range wants {
+		if i == 0 {
+			b.WriteString(encodePktLine(fmt.Sprintf(
+				"want %s shallow ofs-delta side-band-64k agent=%s\n", want, gcloneAgent)))
 		} else {
-			if strings.HasSuffix(line, fmt.Sprintf("refs/heads/%s", defaultBranch)) {
-				fields := strings.Fields(line)
-				if len(fields) > 0 && len(fields[0]) > 4 {
-					return fields[0][4:], defaultBranch, nil
-				}
+			b.WriteString(encodePktLine(fmt.Sprintf("want %s\n", want)))
+		}
+	}
+	if opts.Depth > 0 {
+		b.WriteString(encodePktLine(fmt.Sprintf("deepen %d\n", opts.Depth)))
+	}
+	b.WriteString("0000")
+	for _, have := range haves {
+		b.WriteString(encodePktLine(fmt.Sprintf("have %s\n", have)))
+	}
+	b.WriteString(encodePktLine("done\n"))
+	return b.String()
+}
+
+// parseRefAdvertisement decodes a git-upload-pack ref advertisement: a
+// sequence of pkt-lines "<sha1> <ref>[\0<capabilities>]" terminated by a
+// flush-pkt. The first ref's line carries the capability list (NUL-
+// separated) for the whole advertisement; every later line is a plain
+// "<sha1> <ref>". Used by both HTTPTransport and SSHTransport, since the
+// advertisement format itself doesn't depend on how it was transported.
+func parseRefAdvertisement(data []byte) (refs map[string]string, capabilities []string, err error) {
+	refs = map[string]string{}
+
+	off := 0
+	first := true
+	for off < len(data) {
+		payload, flush, next, err := readPktLine(data, off)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse ref advertisement: %w", err)
+		}
+		off = next
+		if flush {
+			break
+		}
+
+		line := strings.TrimRight(string(payload), "\n")
+		if first {
+			first = false
+			if idx := strings.IndexByte(line, 0); idx >= 0 {
+				capabilities = strings.Fields(line[idx+1:])
+				line = line[:idx]
 			}
 		}
+
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue // e.g. a leading "version 1" line some servers send
+		}
+		hash, ref := fields[0], fields[1]
+		if ref == "capabilities^{}" {
+			continue // the no-refs placeholder line advertised by an empty repo
+		}
+		refs[ref] = hash
 	}
-	return "", "", fmt.Errorf("Default branch hash not found")
+
+	return refs, capabilities, nil
+}
+
+// HTTPTransport speaks the smart-HTTP git protocol: GET info/refs?service=
+// for discovery, POST git-upload-pack for the pack itself.
+type HTTPTransport struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPTransport builds a Transport for an http:// or https:// repoURL.
+func NewHTTPTransport(repoURL string) *HTTPTransport {
+	return &HTTPTransport{url: repoURL, client: &http.Client{}}
 }
 
-func getPackfile(repoURL, mainHash string) ([]byte, error) {
-	fetchURL := fmt.Sprintf("%s/git-upload-pack", repoURL)
-	reqBody := []byte(fmt.Sprintf("0032want %s\n", mainHash) + "0000" + "0009done\n")
+func (t *HTTPTransport) AdvertisedRefs(ctx context.Context) (map[string]string, []string, error) {
+	refsURL := fmt.Sprintf("%s/info/refs?service=git-upload-pack", t.url)
 
-	req, err := http.NewRequest("POST", fetchURL, bytes.NewBuffer(reqBody))
+	req, err := http.NewRequestWithContext(ctx, "GET", refsURL, nil)
 	if err != nil {
-		return []byte{}, fmt.Errorf("ERROR from http.NewRequest: %v", err)
+		return nil, nil, fmt.Errorf("failed to build request to %s: %w", refsURL, err)
 	}
-	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := t.client.Do(req)
 	if err != nil {
-		return []byte{}, fmt.Errorf("ERROR from client.Do: %v", err)
+		return nil, nil, fmt.Errorf("failed to perform GET request to %s: %w", refsURL, err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode >= 400 {
+		return nil, nil, fmt.Errorf("unexpected status code %d while fetching %s",
+			resp.StatusCode, refsURL)
+	}
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return []byte{}, fmt.Errorf("ERROR from io.ReadAll: %v", err)
+		return nil, nil, fmt.Errorf("failed to read response body from %s: %w", refsURL, err)
 	}
 
-	if len(body) < 8 {
-		return nil, fmt.Errorf("response body too short: %d bytes", len(body))
+	// The smart-HTTP discovery response prefixes the usual pkt-line ref
+	// advertisement with a "# service=git-upload-pack" pkt-line and a
+	// flush-pkt; skip past both before the shared parser takes over.
+	_, _, afterService, err := readPktLine(body, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse service header: %w", err)
+	}
+	_, flush, afterFlush, err := readPktLine(body, afterService)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse service header flush: %w", err)
 	}
-	if string(body[4:7]) != "NAK" {
-		return nil, fmt.Errorf("missing NAK, got %q", body[4:7])
+	if !flush {
+		return nil, nil, fmt.Errorf("expected flush-pkt after service header")
 	}
-	return body[8:], nil
+
+	return parseRefAdvertisement(body[afterFlush:])
 }
 
-func compressBytes(data []byte) ([]byte, error) {
-	var buf bytes.Buffer
+func (t *HTTPTransport) UploadPack(ctx context.Context, wants, haves []string, opts UploadPackOptions) (io.ReadCloser, error) {
+	fetchURL := fmt.Sprintf("%s/git-upload-pack", t.url)
+	reqBody := buildUploadPackRequest(wants, haves, opts)
 
-	w := zlib.NewWriter(&buf)
+	req, err := http.NewRequestWithContext(ctx, "POST", fetchURL, strings.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request to %s: %w", fetchURL, err)
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
 
-	_, err := w.Write(data)
+	resp, err := t.client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to perform POST request to %s: %w", fetchURL, err)
 	}
+	return resp.Body, nil
+}
 
-	if err := w.Close(); err != nil {
-		return nil, err
+// parseSSHURL accepts both the scp-like shorthand git@host:path/to/repo.git
+// and the explicit ssh://[user@]host[:port]/path/to/repo.git form.
+func parseSSHURL(repoURL string) (user, host, port, path string, err error) {
+	if strings.HasPrefix(repoURL, "ssh://") {
+		u, err := url.Parse(repoURL)
+		if err != nil {
+			return "", "", "", "", fmt.Errorf("invalid ssh URL %q: %w", repoURL, err)
+		}
+		port := u.Port()
+		if port == "" {
+			port = "22"
+		}
+		user := ""
+		if u.User != nil {
+			user = u.User.Username()
+		}
+		return user, u.Hostname(), port, strings.TrimPrefix(u.Path, "/"), nil
 	}
 
-	return buf.Bytes(), nil
+	at := strings.Index(repoURL, "@")
+	colon := strings.Index(repoURL, ":")
+	if at < 0 || colon < at {
+		return "", "", "", "", fmt.Errorf("unrecognized ssh remote %q", repoURL)
+	}
+	return repoURL[:at], repoURL[at+1 : colon], "22", repoURL[colon+1:], nil
 }
 
-func decompressBytes(data []byte) ([]byte, error) {
-	buf := bytes.NewReader(data)
-	r, err := zlib.NewReader(buf)
+// isSCPLikeSSH reports whether repoURL looks like the scp-style shorthand
+// git@host:path (an "@" followed later by a ":", with no "://" scheme).
+func isSCPLikeSSH(repoURL string) bool {
+	if strings.Contains(repoURL, "://") {
+		return false
+	}
+	at := strings.Index(repoURL, "@")
+	colon := strings.Index(repoURL, ":")
+	return at >= 0 && colon > at
+}
+
+// sshAuthMethods resolves SSH authentication the way the system ssh client
+// does: an explicit -i keyfile if one was given, otherwise whatever
+// identities the running ssh-agent at SSH_AUTH_SOCK offers.
+func sshAuthMethods(identityFile string) ([]ssh.AuthMethod, error) {
+	if identityFile != "" {
+		key, err := os.ReadFile(identityFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read identity file %s: %w", identityFile, err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse identity file %s: %w", identityFile, err)
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil
+	}
+
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, fmt.Errorf("no -i keyfile given and SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", sock)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to connect to ssh-agent at %s: %w", sock, err)
 	}
-	defer r.Close()
+	return []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(conn).Signers)}, nil
+}
 
-	var out bytes.Buffer
-	_, err = out.ReadFrom(r)
+// sshHostKeyCallback verifies the server's host key against the user's
+// known_hosts, the same trust store the system ssh client uses; a host not
+// already recorded there is rejected rather than silently trusted.
+func sshHostKeyCallback() (ssh.HostKeyCallback, error) {
+	home, err := os.UserHomeDir()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to resolve home directory for known_hosts: %w", err)
 	}
+	return knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+}
 
-	return out.Bytes(), nil
+// SSHTransport speaks the git pack protocol over `ssh ... git-upload-pack
+// '<path>'`, the same way the real git client does for a git@host:path or
+// ssh:// remote. Unlike HTTPTransport, a single SSH session serves both
+// AdvertisedRefs and UploadPack: the server starts streaming the ref
+// advertisement the moment the command runs, and the same stdin/stdout
+// pair carries the want/have/done request and the packfile response, so
+// the session is opened lazily on the first call and reused by the second.
+type SSHTransport struct {
+	user         string
+	host         string
+	port         string
+	path         string
+	identityFile string
+
+	client  *ssh.Client
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
 }
 
-func writeObject(content []byte, objType string) error {
-	// The object format is:
-	// <type> <size>\0<content>
+// NewSSHTransport builds a Transport for a git@host:path or ssh://host/path
+// remote. identityFile, if non-empty, is used as a `-i keyfile` override;
+// otherwise auth goes through the running ssh-agent, matching the default
+// behavior of the system ssh and git clients.
+func NewSSHTransport(repoURL, identityFile string) (*SSHTransport, error) {
+	user, host, port, path, err := parseSSHURL(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	if user == "" {
+		user = "git"
+	}
+	return &SSHTransport{user: user, host: host, port: port, path: path, identityFile: identityFile}, nil
+}
 
-	size := len(content)
-	header := fmt.Sprintf("%s %d", objType, size)
-	objContent := append([]byte{}, []byte(header)...)
-	objContent = append(objContent, 0x00)
-	objContent = append(objContent, content...)
+// shellQuoteSingle quotes s as a single POSIX shell argument, the way real
+// git escapes the remote repo path before splicing it into the
+// `git-upload-pack '<path>'` command line it asks the server's shell to run.
+func shellQuoteSingle(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
 
-	hasher := sha1.New()
-	hasher.Write(objContent)
-	hash := hex.EncodeToString(hasher.Sum(nil))
+// ensureSession dials the remote and starts git-upload-pack on first use;
+// later calls reuse the already-running session. Only the dial respects
+// ctx cancellation/deadlines — golang.org/x/crypto/ssh's Session has no
+// context-aware API for Start or its stdin/stdout once the handshake completes.
+func (t *SSHTransport) ensureSession(ctx context.Context) error {
+	if t.session != nil {
+		return nil
+	}
 
-	objDirPath := filepath.Join(".git/objects", hash[:2])
-	err := os.MkdirAll(objDirPath, 0755)
+	auth, err := sshAuthMethods(t.identityFile)
 	if err != nil {
-		return fmt.Errorf("failed to create %s: %w", objDirPath, err)
+		return err
 	}
-	objPath := filepath.Join(objDirPath, hash[2:])
-
-	objContent, err = compressBytes(objContent)
+	hostKeyCallback, err := sshHostKeyCallback()
 	if err != nil {
-		return fmt.Errorf("failed to compress object content: %w", err)
+		return err
 	}
 
-	if err := os.WriteFile(objPath, objContent, 0644); err != nil {
-		return fmt.Errorf("failed to write to %s: %w", objPath, err)
+	addr := net.JoinHostPort(t.host, t.port)
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to dial %s@%s: %w", t.user, t.host, err)
 	}
-	return nil
-}
-
-func readObject(hash string) ([]byte, string, error) {
-	// The object format is:
-	// <type> <size>\0<content>
-	objPath := filepath.Join(".git/objects", hash[:2], hash[2:])
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:            t.user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to handshake with %s@%s: %w", t.user, t.host, err)
+	}
+	client := ssh.NewClient(clientConn, chans, reqs)
 
-	objContent, err := os.ReadFile(objPath)
+	session, err := client.NewSession()
 	if err != nil {
-		return []byte{}, "", fmt.Errorf("failed to read obj: %w", err)
+		client.Close()
+		return fmt.Errorf("failed to open ssh session: %w", err)
 	}
 
-	objContent, err = decompressBytes(objContent)
+	stdin, err := session.StdinPipe()
 	if err != nil {
-		return []byte{}, "", fmt.Errorf("failed to decompress object content: %w", err)
+		session.Close()
+		client.Close()
+		return fmt.Errorf("failed to open session stdin: %w", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		client.Close()
+		return fmt.Errorf("failed to open session stdout: %w", err)
 	}
 
-	nullIdx := bytes.IndexByte(objContent, 0)
-	if nullIdx == -1 {
-		return []byte{}, "",
-			fmt.Errorf("failed to find null byte in object file: %s", objPath)
+	if err := session.Start("git-upload-pack " + shellQuoteSingle(t.path)); err != nil {
+		session.Close()
+		client.Close()
+		return fmt.Errorf("failed to start git-upload-pack: %w", err)
 	}
 
-	header := objContent[:nullIdx]
-	content := objContent[nullIdx+1:]
+	t.client, t.session, t.stdin, t.stdout = client, session, stdin, stdout
+	return nil
+}
 
-	spaceIdx := bytes.IndexByte(header, byte(' '))
-	if spaceIdx == -1 {
-		return []byte{}, "",
-			fmt.Errorf("failed to find space byte in object file: %s", objPath)
-	}
+// readPktLinesUntilFlush reads successive pkt-lines from r, returning every
+// byte read (each pkt-line's 4-byte length header included) up to and
+// including the terminating flush-pkt, so the result can be fed straight
+// into a []byte-based pkt-line parser like parseRefAdvertisement.
+func readPktLinesUntilFlush(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	lenBuf := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, lenBuf); err != nil {
+			return nil, fmt.Errorf("failed to read pkt-line length: %w", err)
+		}
+		buf.Write(lenBuf)
 
-	objType := string(header[:spaceIdx])
+		length, err := strconv.ParseInt(string(lenBuf), 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pkt-line length %q: %w", lenBuf, err)
+		}
+		if length == 0 {
+			return buf.Bytes(), nil
+		}
+		if length < 4 {
+			return nil, fmt.Errorf("invalid pkt-line length %d", length)
+		}
 
-	size, err := strconv.Atoi(string(header[spaceIdx+1:]))
-	if err != nil {
-		return nil, "", fmt.Errorf("invalid size in object header: %w", err)
+		payload := make([]byte, length-4)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, fmt.Errorf("failed to read pkt-line payload: %w", err)
+		}
+		buf.Write(payload)
 	}
+}
 
-	if size != len(content) {
-		return nil, "",
-			fmt.Errorf("size mismatch: declared %d, got %d",
-				size, len(content))
+func (t *SSHTransport) AdvertisedRefs(ctx context.Context) (map[string]string, []string, error) {
+	if err := t.ensureSession(ctx); err != nil {
+		return nil, nil, err
 	}
 
-	return content, objType, nil
+	advertisement, err := readPktLinesUntilFlush(t.stdout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read ref advertisement: %w", err)
+	}
+	return parseRefAdvertisement(advertisement)
 }
 
-func getObjectsCount(pack []byte) (uint32, error) {
-	if len(pack) < 12 {
-		return 0, fmt.Errorf("packfile too short: %d bytes", len(pack))
-	}
-	if string(pack[:4]) != "PACK" {
-		return 0, fmt.Errorf(" Bad packfile format: missing 'PACK' in header")
+// sshUploadPackBody adapts the SSH session's stdout pipe (which has no
+// Close of its own) into an io.ReadCloser that tears down the session and
+// its connection once the caller has finished reading the packfile.
+type sshUploadPackBody struct {
+	io.Reader
+	session *ssh.Session
+	client  *ssh.Client
+}
+
+func (b *sshUploadPackBody) Close() error {
+	sessErr := b.session.Close()
+	clientErr := b.client.Close()
+	if sessErr != nil {
+		return sessErr
 	}
-	return binary.BigEndian.Uint32(pack[8:12]), nil
+	return clientErr
 }
 
-func verifyChecksum(pack []byte) bool {
-	packLen := len(pack)
-	if packLen < 20 {
-		return false
+func (t *SSHTransport) UploadPack(ctx context.Context, wants, haves []string, opts UploadPackOptions) (io.ReadCloser, error) {
+	if t.session == nil {
+		return nil, fmt.Errorf("UploadPack called before AdvertisedRefs established a session")
 	}
-	expectedChecksum := pack[packLen-20:]
 
-	hash := sha1.New()
-	hash.Write(pack[:packLen-20])
-	calculatedChecksum := hash.Sum(nil)
+	reqBody := buildUploadPackRequest(wants, haves, opts)
+	if _, err := io.WriteString(t.stdin, reqBody); err != nil {
+		return nil, fmt.Errorf("failed to write upload-pack request: %w", err)
+	}
+	if err := t.stdin.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close upload-pack request stream: %w", err)
+	}
 
-	return bytes.Equal(expectedChecksum, calculatedChecksum)
+	return &sshUploadPackBody{Reader: t.stdout, session: t.session, client: t.client}, nil
 }
 
-func parsePackfile(pack []byte) ([]Delta, error) {
-	if !verifyChecksum(pack) {
-		return []Delta{}, fmt.Errorf("Checksum verification failed")
+// gcloneAgent is advertised to the server as the agent= capability.
+const gcloneAgent = "gclone/1.0"
+
+// encodePktLine frames payload (which must already include its own trailing
+// newline, as git-upload-pack expects) as a pkt-line: a 4-byte hex length,
+// counting itself, followed by the payload verbatim.
+func encodePktLine(payload string) string {
+	return fmt.Sprintf("%04x%s", len(payload)+4, payload)
+}
+
+// readPktLine decodes the pkt-line starting at off within data, returning
+// its payload (without the 4-byte length header), whether it was a
+// flush-pkt ("0000", which carries no payload), and the offset of the next
+// pkt-line.
+func readPktLine(data []byte, off int) (payload []byte, flush bool, next int, err error) {
+	if off+4 > len(data) {
+		return nil, false, 0, fmt.Errorf("unexpected end of data while reading pkt-line length")
 	}
 
-	objsCount, err := getObjectsCount(pack)
+	length, err := strconv.ParseInt(string(data[off:off+4]), 16, 64)
 	if err != nil {
-		return []Delta{}, err
+		return nil, false, 0, fmt.Errorf("invalid pkt-line length %q: %w", data[off:off+4], err)
+	}
+	if length == 0 {
+		return nil, true, off + 4, nil
+	}
+	if length < 4 {
+		return nil, false, 0, fmt.Errorf("invalid pkt-line length %d", length)
 	}
 
-	// skip pack header and checksum
-	pack = pack[12 : len(pack)-20]
-
-	deltas := []Delta{}
+	end := off + int(length)
+	if end > len(data) {
+		return nil, false, 0, fmt.Errorf("pkt-line length %d exceeds remaining data", length)
+	}
 
-	off := int64(0)
-	for i := uint32(0); i < objsCount; i++ {
-		if off >= int64(len(pack)) {
-			return []Delta{}, fmt.Errorf(
-				"unexpected end of packfile at offset %d",
-				off,
-			)
-		}
+	return data[off+4 : end], false, end, nil
+}
 
-		byt := pack[off]
-		off++
+// demuxSideband splits a side-band-64k multiplexed stream of pkt-lines into
+// its pack data, discarding progress messages (band 2) and surfacing a
+// fatal error (band 3) as a Go error. Stops at the stream's flush-pkt (or
+// its end, for servers that omit it).
+func demuxSideband(data []byte) ([]byte, error) {
+	var pack bytes.Buffer
 
-		objType := (byt >> 4) & 0x7
-		if _, ok := objTypeNames[objType]; !ok {
-			return []Delta{},
-				fmt.Errorf("Bad object type in the packfile: %d", objType)
+	off := 0
+	for off < len(data) {
+		payload, flush, next, err := readPktLine(data, off)
+		if err != nil {
+			return nil, err
 		}
-
-		objSize := int64(byt & 0xF)
-		shift := 4
-
-		if (byt & 0x80) != 0 {
-			for {
-				if off >= int64(len(pack)) {
-					return []Delta{}, fmt.Errorf(
-						"unexpected end of packfile at offset %d",
-						off,
-					)
-				}
-				byt = pack[off]
-				off++
-
-				if shift > 60 {
-					return []Delta{}, fmt.Errorf(
-						"object size encoding too large at offset %d",
-						off-1,
-					)
-				}
-				objSize |= int64((int64(byt & 0x7F)) << shift)
-				shift += 7
-
-				if (byt & 0x80) == 0 {
-					break
-				}
-			}
+		off = next
+		if flush {
+			break
 		}
-
-		refDeltaHash := []byte{}
-		if objType == OBJ_REF_DELTA {
-			if off+20 > int64(len(pack)) {
-				return []Delta{},
-					fmt.Errorf(
-						"unexpected end of packfile while reading ref delta hash",
-					)
-			}
-			refDeltaHash = pack[off : off+20]
-			off += 20
+		if len(payload) == 0 {
+			continue
 		}
 
-		if off >= int64(len(pack)) {
-			return []Delta{}, fmt.Errorf(
-				"unexpected end of packfile at offset %d",
-				off,
-			)
+		switch band, content := payload[0], payload[1:]; band {
+		case 1:
+			pack.Write(content)
+		case 2:
+			// progress text meant for the user's terminal; not our concern.
+		case 3:
+			return nil, fmt.Errorf("upload-pack error: %s", content)
+		default:
+			return nil, fmt.Errorf("unknown sideband channel %d", band)
 		}
+	}
 
-		bytesReader := bytes.NewReader(pack[off:])
-		zlibReader, err := zlib.NewReader(bytesReader)
-		if err != nil {
-			return []Delta{}, fmt.Errorf("zlib.NewReader has failed: %v", err)
-		}
+	return pack.Bytes(), nil
+}
 
-		raw, err := io.ReadAll(zlibReader)
-		zlibReader.Close()
+// parseUploadPackResponse walks the pkt-lines preceding the packfile in a
+// git-upload-pack response: any number of `shallow <sha>`/`unshallow <sha>`
+// lines (present when depth was requested), then the NAK/ACK line that used
+// to be read at the hardcoded offset body[4:7]. Everything after that is
+// the packfile, demultiplexed via demuxSideband since side-band-64k is
+// always advertised in the request. Returns the pack bytes and the sha1s
+// from any `shallow` lines, for writeShallowFile.
+func parseUploadPackResponse(body []byte) ([]byte, []string, error) {
+	shallowHashes := []string{}
+
+	off := 0
+	sawAckOrNak := false
+	for !sawAckOrNak {
+		payload, flush, next, err := readPktLine(body, off)
 		if err != nil {
-			return []Delta{}, fmt.Errorf("io.ReadAll has failed: %v", err)
+			return nil, nil, fmt.Errorf("failed to parse upload-pack response: %w", err)
+		}
+		off = next
+		if flush {
+			continue
 		}
 
-		if int64(len(raw)) != objSize {
-			return []Delta{}, fmt.Errorf(
-				"object size mismatch: expected %d bytes, got %d bytes",
-				objSize, len(raw),
-			)
+		line := string(payload)
+		switch {
+		case strings.HasPrefix(line, "shallow "):
+			shallowHashes = append(shallowHashes, strings.TrimSpace(strings.TrimPrefix(line, "shallow ")))
+		case strings.HasPrefix(line, "unshallow "):
+			// boundary commit un-deepened past; nothing for us to record.
+		case strings.HasPrefix(line, "NAK") || strings.HasPrefix(line, "ACK"):
+			sawAckOrNak = true
+		default:
+			return nil, nil, fmt.Errorf("unexpected upload-pack response line %q", line)
 		}
+	}
 
-		off += bytesReader.Size() - int64(bytesReader.Len())
+	pack, err := demuxSideband(body[off:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return pack, shallowHashes, nil
+}
 
-		if objType == OBJ_REF_DELTA {
-			deltas = append(deltas, Delta{
-				hash: hex.EncodeToString(refDeltaHash),
-				data: raw,
-			})
-		} else {
-			err = writeObject(raw, objTypeNames[objType])
-			if err != nil {
-				return []Delta{}, fmt.Errorf("failed to write object: %w", err)
-			}
-		}
+// getPackfile requests mainHash (and, if depth > 0, only its most recent
+// depth commits via the shallow-clone `deepen` extension) through t and
+// returns the received packfile plus the sha1s of any commits the server
+// reports as shallow boundaries. It always advertises (and assumes the
+// server honors) side-band-64k, which every server this tool targets
+// supports; a server too old to multiplex its response this way would need
+// its capability advertisement checked first, which getMainHash doesn't do.
+func getPackfile(t Transport, mainHash string, depth int) ([]byte, []string, error) {
+	rc, err := t.UploadPack(context.Background(), []string{mainHash}, nil, UploadPackOptions{Depth: depth})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rc.Close()
+
+	body, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read upload-pack response: %w", err)
 	}
-	return deltas, nil
+
+	return parseUploadPackResponse(body)
 }
 
-func parseVarInt(data []byte) (int64, int64, error) {
-	var shift int8
-	var off, value int64
-	for {
-		if off >= int64(len(data)) {
-			return 0, 0, fmt.Errorf(
-				"unexpected end of data at %d",
-				off,
-			)
-		}
-		byt := data[off]
-		off++
+// writeShallowFile records shallow boundary commits (ones the shallow-clone
+// `deepen` extension cut history off at) to .git/shallow, one hash per
+// line, the way git marks a clone as shallow.
+func writeShallowFile(hashes []string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
 
-		if shift > 60 {
-			return 0, 0, fmt.Errorf(
-				"object size encoding too large at %d",
-				off-1,
+	shallowPath := filepath.Join(".git", "shallow")
+	content := strings.Join(hashes, "\n") + "\n"
+	if err := os.WriteFile(shallowPath, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write to %s: %w", shallowPath, err)
+	}
+	return nil
+}
+
+func compressBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w := zlib.NewWriter(&buf)
+
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decompressBytes(data []byte) ([]byte, error) {
+	buf := bytes.NewReader(data)
+	r, err := zlib.NewReader(buf)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var out bytes.Buffer
+	_, err = out.ReadFrom(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+func writeObject(content []byte, objType string) (string, error) {
+	// The object format is:
+	// <type> <size>\0<content>
+
+	hash := hashContent(content, objType)
+
+	header := fmt.Sprintf("%s %d", objType, len(content))
+	objContent := append([]byte{}, []byte(header)...)
+	objContent = append(objContent, 0x00)
+	objContent = append(objContent, content...)
+
+	objDirPath := filepath.Join(".git/objects", hash[:2])
+	err := os.MkdirAll(objDirPath, 0755)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", objDirPath, err)
+	}
+	objPath := filepath.Join(objDirPath, hash[2:])
+
+	objContent, err = compressBytes(objContent)
+	if err != nil {
+		return "", fmt.Errorf("failed to compress object content: %w", err)
+	}
+
+	if err := os.WriteFile(objPath, objContent, 0644); err != nil {
+		return "", fmt.Errorf("failed to write to %s: %w", objPath, err)
+	}
+	return hash, nil
+}
+
+// LargeObjectThreshold is the target-content size, in bytes, at or above
+// which delta resolution and object writes stream through disk instead of
+// building the whole object in memory first. 0 makes everything stream.
+var LargeObjectThreshold int64 = 1 << 20 // 1 MiB
+
+// StorageMode selects how a clone's objects end up on disk: "loose"
+// explodes every object to its own .git/objects/xx/yyyy... file (the
+// original behavior), "packed" keeps the received pack verbatim under
+// .git/objects/pack/ alongside a generated .idx and never writes loose
+// objects, matching what a real git client does after a normal clone.
+// The LargeObjectThreshold streaming path only applies in loose mode: in
+// packed mode the received pack already sits fully in memory, so there is
+// nothing to gain from streaming a large object to a temp file just to
+// hash it.
+var StorageMode = "loose"
+
+// hashContent computes the sha1 object hash of content for objType the way
+// git does, without writing anything to disk: sha1("<type> <size>\0<content>").
+func hashContent(content []byte, objType string) string {
+	header := fmt.Sprintf("%s %d", objType, len(content))
+	hasher := sha1.New()
+	hasher.Write([]byte(header))
+	hasher.Write([]byte{0})
+	hasher.Write(content)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// DefaultObjectCacheBudget is the byte budget ObjectCache is created with.
+// Ref-deltas very often share a base, and thin packs resolve their base via
+// readObject, so without a cache that base gets re-read and re-decompressed
+// once per delta that points at it.
+const DefaultObjectCacheBudget = 96 << 20 // 96 MiB
+
+// ObjectCache caches decompressed object content by sha1 hash across
+// readObject lookups and delta-base resolution, so a base object shared by
+// many deltas is only ever read and decompressed once. It's a byte-budget
+// LRU, not an entry-count one, since object sizes vary wildly; set it to
+// NewBufferLRU(0) to disable caching for memory-constrained callers.
+var ObjectCache = NewBufferLRU(DefaultObjectCacheBudget)
+
+// bufferLRUEntry is one ObjectCache slot: an object's decompressed content
+// and type, keyed externally by its sha1 hash.
+type bufferLRUEntry struct {
+	hash    string
+	content []byte
+	objType string
+}
+
+// BufferLRU is a sha1-keyed cache of decompressed object content, bounded
+// by total bytes cached rather than entry count, evicting the
+// least-recently-used entry when a Put would exceed the budget.
+type BufferLRU struct {
+	mu     sync.Mutex
+	budget int64
+	size   int64
+	ll     *list.List
+	items  map[string]*list.Element
+}
+
+// NewBufferLRU creates a BufferLRU with the given byte budget. A budget of
+// 0 (or less) makes Get always miss and Put a no-op, effectively disabling
+// the cache.
+func NewBufferLRU(budget int64) *BufferLRU {
+	return &BufferLRU{
+		budget: budget,
+		ll:     list.New(),
+		items:  make(map[string]*list.Element),
+	}
+}
+
+// Get returns hash's cached content and object type, marking it
+// most-recently-used on a hit.
+func (c *BufferLRU) Get(hash string) ([]byte, string, bool) {
+	if c.budget <= 0 {
+		return nil, "", false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[hash]
+	if !ok {
+		return nil, "", false
+	}
+	c.ll.MoveToFront(el)
+
+	entry := el.Value.(*bufferLRUEntry)
+	return entry.content, entry.objType, true
+}
+
+// Put caches hash's content and object type, evicting least-recently-used
+// entries until the cache fits within budget again. An entry larger than
+// the whole budget is simply not cached.
+func (c *BufferLRU) Put(hash string, content []byte, objType string) {
+	if c.budget <= 0 || int64(len(content)) > c.budget {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[hash]; ok {
+		entry := el.Value.(*bufferLRUEntry)
+		c.size += int64(len(content)) - int64(len(entry.content))
+		entry.content = content
+		entry.objType = objType
+		c.ll.MoveToFront(el)
+	} else {
+		el := c.ll.PushFront(&bufferLRUEntry{hash: hash, content: content, objType: objType})
+		c.items[hash] = el
+		c.size += int64(len(content))
+	}
+
+	for c.size > c.budget {
+		back := c.ll.Back()
+		if back == nil {
+			break
+		}
+		entry := back.Value.(*bufferLRUEntry)
+		c.size -= int64(len(entry.content))
+		c.ll.Remove(back)
+		delete(c.items, entry.hash)
+	}
+}
+
+// persistObject makes content available for later delta-base lookups and
+// caches it: in loose mode that means writing it to .git/objects, in packed
+// mode (where nothing is written to disk until the whole pack is flushed at
+// the end) it only computes the hash.
+func persistObject(content []byte, objType string) (string, error) {
+	var hash string
+	if StorageMode == "packed" {
+		hash = hashContent(content, objType)
+	} else {
+		var err error
+		hash, err = writeObject(content, objType)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	ObjectCache.Put(hash, content, objType)
+	return hash, nil
+}
+
+// countingReader wraps an io.Reader and tallies the bytes it has yielded,
+// so a caller that must enforce a declared length can check it after the
+// fact without buffering the content itself.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeObjectStream is the streaming counterpart to writeObject: it drains
+// r, which must yield exactly size bytes of object content, straight into
+// a zlib writer while hashing it, so the caller never holds the full
+// object in memory. Used for objects at or above LargeObjectThreshold.
+func writeObjectStream(r io.Reader, objType string, size int64) (hash string, err error) {
+	header := []byte(fmt.Sprintf("%s %d", objType, size))
+
+	tmpFile, err := os.CreateTemp(".git/objects", "tmp-obj-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp object file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	hasher := sha1.New()
+	zw := zlib.NewWriter(tmpFile)
+
+	counted := &countingReader{r: r}
+	full := io.MultiReader(bytes.NewReader(header), bytes.NewReader([]byte{0}), counted)
+	if _, err = io.Copy(zw, io.TeeReader(full, hasher)); err != nil {
+		tmpFile.Close()
+		return "", fmt.Errorf("failed to compress object content: %w", err)
+	}
+	if counted.n != size {
+		tmpFile.Close()
+		err = fmt.Errorf("object content size(%d) doesn't match declared size(%d)", counted.n, size)
+		return "", err
+	}
+	if err = zw.Close(); err != nil {
+		tmpFile.Close()
+		return "", fmt.Errorf("failed to compress object content: %w", err)
+	}
+	if err = tmpFile.Close(); err != nil {
+		return "", fmt.Errorf("failed to close temp object file: %w", err)
+	}
+
+	hash = hex.EncodeToString(hasher.Sum(nil))
+	objDirPath := filepath.Join(".git/objects", hash[:2])
+	if err = os.MkdirAll(objDirPath, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", objDirPath, err)
+	}
+	objPath := filepath.Join(objDirPath, hash[2:])
+	if err = os.Rename(tmpPath, objPath); err != nil {
+		return "", fmt.Errorf("failed to write to %s: %w", objPath, err)
+	}
+
+	return hash, nil
+}
+
+func readObject(hash string) ([]byte, string, error) {
+	if content, objType, ok := ObjectCache.Get(hash); ok {
+		return content, objType, nil
+	}
+
+	content, objType, err := readObjectUncached(hash)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ObjectCache.Put(hash, content, objType)
+	return content, objType, nil
+}
+
+// readObjectUncached is readObject's actual lookup, bypassing ObjectCache:
+// from the pack store in packed mode, from a loose .git/objects file
+// otherwise.
+func readObjectUncached(hash string) ([]byte, string, error) {
+	if StorageMode == "packed" {
+		return readObjectFromPackStore(hash)
+	}
+
+	// The object format is:
+	// <type> <size>\0<content>
+	objPath := filepath.Join(".git/objects", hash[:2], hash[2:])
+
+	objContent, err := os.ReadFile(objPath)
+	if err != nil {
+		return []byte{}, "", fmt.Errorf("failed to read obj: %w", err)
+	}
+
+	objContent, err = decompressBytes(objContent)
+	if err != nil {
+		return []byte{}, "", fmt.Errorf("failed to decompress object content: %w", err)
+	}
+
+	nullIdx := bytes.IndexByte(objContent, 0)
+	if nullIdx == -1 {
+		return []byte{}, "",
+			fmt.Errorf("failed to find null byte in object file: %s", objPath)
+	}
+
+	header := objContent[:nullIdx]
+	content := objContent[nullIdx+1:]
+
+	spaceIdx := bytes.IndexByte(header, byte(' '))
+	if spaceIdx == -1 {
+		return []byte{}, "",
+			fmt.Errorf("failed to find space byte in object file: %s", objPath)
+	}
+
+	objType := string(header[:spaceIdx])
+
+	size, err := strconv.Atoi(string(header[spaceIdx+1:]))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid size in object header: %w", err)
+	}
+
+	if size != len(content) {
+		return nil, "",
+			fmt.Errorf("size mismatch: declared %d, got %d",
+				size, len(content))
+	}
+
+	return content, objType, nil
+}
+
+func getObjectsCount(pack []byte) (uint32, error) {
+	if len(pack) < 12 {
+		return 0, fmt.Errorf("packfile too short: %d bytes", len(pack))
+	}
+	if string(pack[:4]) != "PACK" {
+		return 0, fmt.Errorf(" Bad packfile format: missing 'PACK' in header")
+	}
+	return binary.BigEndian.Uint32(pack[8:12]), nil
+}
+
+func verifyChecksum(pack []byte) bool {
+	packLen := len(pack)
+	if packLen < 20 {
+		return false
+	}
+	expectedChecksum := pack[packLen-20:]
+
+	hash := sha1.New()
+	hash.Write(pack[:packLen-20])
+	calculatedChecksum := hash.Sum(nil)
+
+	return bytes.Equal(expectedChecksum, calculatedChecksum)
+}
+
+// packEntryHeader is the decoded fixed-size portion of a pack object entry:
+// its type and declared content size, plus — for delta entries — its base.
+// Shared by parsePackfile's sequential scan and readPackObjectAt's random
+// access so the two can't silently diverge on how they decode an entry.
+type packEntryHeader struct {
+	objType    byte
+	objSize    int64
+	baseOffset int64
+	baseHash   string
+}
+
+// parsePackEntryHeader decodes the entry starting at off within pack: the
+// type/size varint, then, for OBJ_REF_DELTA/OBJ_OFS_DELTA, the base hash or
+// base offset that follows it. It returns the decoded header and the offset
+// at which the entry's zlib-compressed payload begins.
+func parsePackEntryHeader(pack []byte, off int64) (packEntryHeader, int64, error) {
+	entryOffset := off
+	if off >= int64(len(pack)) {
+		return packEntryHeader{}, 0, fmt.Errorf(
+			"unexpected end of packfile at offset %d", off)
+	}
+
+	byt := pack[off]
+	off++
+
+	objType := (byt >> 4) & 0x7
+	if _, ok := objTypeNames[objType]; !ok {
+		return packEntryHeader{}, 0,
+			fmt.Errorf("Bad object type in the packfile: %d", objType)
+	}
+
+	objSize := int64(byt & 0xF)
+	shift := 4
+
+	if (byt & 0x80) != 0 {
+		for {
+			if off >= int64(len(pack)) {
+				return packEntryHeader{}, 0, fmt.Errorf(
+					"unexpected end of packfile at offset %d", off)
+			}
+			byt = pack[off]
+			off++
+
+			if shift > 60 {
+				return packEntryHeader{}, 0, fmt.Errorf(
+					"object size encoding too large at offset %d", off-1)
+			}
+			objSize |= int64((int64(byt & 0x7F)) << shift)
+			shift += 7
+
+			if (byt & 0x80) == 0 {
+				break
+			}
+		}
+	}
+
+	hdr := packEntryHeader{objType: objType, objSize: objSize}
+
+	if objType == OBJ_REF_DELTA {
+		if off+20 > int64(len(pack)) {
+			return packEntryHeader{}, 0, fmt.Errorf(
+				"unexpected end of packfile while reading ref delta hash")
+		}
+		hdr.baseHash = hex.EncodeToString(pack[off : off+20])
+		off += 20
+	} else if objType == OBJ_OFS_DELTA {
+		negOffset, read, err := parseOfsDeltaOffset(pack, off)
+		if err != nil {
+			return packEntryHeader{}, 0, fmt.Errorf("failed to parse ofs delta offset: %w", err)
+		}
+		off += read
+		hdr.baseOffset = entryOffset - negOffset
+	}
+
+	return hdr, off, nil
+}
+
+func parsePackfile(pack []byte) ([]*PackObject, error) {
+	if !verifyChecksum(pack) {
+		return nil, fmt.Errorf("Checksum verification failed")
+	}
+
+	objsCount, err := getObjectsCount(pack)
+	if err != nil {
+		return nil, err
+	}
+
+	// skip pack header and checksum
+	pack = pack[12 : len(pack)-20]
+
+	objects := make([]*PackObject, 0, objsCount)
+
+	off := int64(0)
+	for i := uint32(0); i < objsCount; i++ {
+		if off >= int64(len(pack)) {
+			return nil, fmt.Errorf(
+				"unexpected end of packfile at offset %d",
+				off,
+			)
+		}
+
+		entryOffset := off
+		hdr, newOff, err := parsePackEntryHeader(pack, off)
+		if err != nil {
+			return nil, err
+		}
+		off = newOff
+
+		objType := hdr.objType
+		objSize := hdr.objSize
+
+		obj := &PackObject{offset: entryOffset, packType: objType}
+		obj.baseHash = hdr.baseHash
+		obj.baseOffset = hdr.baseOffset
+
+		if off >= int64(len(pack)) {
+			return nil, fmt.Errorf(
+				"unexpected end of packfile at offset %d",
+				off,
+			)
+		}
+
+		isDelta := objType == OBJ_REF_DELTA || objType == OBJ_OFS_DELTA
+
+		bytesReader := bytes.NewReader(pack[off:])
+		zlibReader, err := zlib.NewReader(bytesReader)
+		if err != nil {
+			return nil, fmt.Errorf("zlib.NewReader has failed: %v", err)
+		}
+
+		// Large non-delta objects (typically blobs) are streamed straight
+		// to a loose object on disk instead of buffered whole, so a single
+		// multi-hundred-MB blob doesn't blow up memory. Their content is
+		// re-read from disk via readObject if a later delta needs it as a
+		// base (see resolveDeltaObject).
+		if !isDelta && objSize >= LargeObjectThreshold && StorageMode != "packed" {
+			hash, err := writeObjectStream(zlibReader, objTypeNames[objType], objSize)
+			zlibReader.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to write object: %w", err)
+			}
+			off += bytesReader.Size() - int64(bytesReader.Len())
+
+			obj.hash = hash
+			obj.objType = objTypeNames[objType]
+			obj.crc32 = crc32.ChecksumIEEE(pack[entryOffset:off])
+			objects = append(objects, obj)
+			continue
+		}
+
+		raw, err := io.ReadAll(zlibReader)
+		zlibReader.Close()
+		if err != nil {
+			return nil, fmt.Errorf("io.ReadAll has failed: %v", err)
+		}
+
+		if int64(len(raw)) != objSize {
+			return nil, fmt.Errorf(
+				"object size mismatch: expected %d bytes, got %d bytes",
+				objSize, len(raw),
+			)
+		}
+
+		off += bytesReader.Size() - int64(bytesReader.Len())
+		obj.crc32 = crc32.ChecksumIEEE(pack[entryOffset:off])
+
+		if isDelta {
+			obj.payload = raw
+		} else {
+			obj.content = raw
+			obj.objType = objTypeNames[objType]
+		}
+
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
+
+// parseOfsDeltaOffset decodes an OBJ_OFS_DELTA base offset: a varint using
+// the MSB as a continuation bit like parseVarInt, but chained with
+// value = ((value+1)<<7) | (byte&0x7F) instead of a plain shift-and-or, so
+// it can encode large backward offsets in few bytes. The result is the
+// distance to subtract from the delta entry's own offset to reach its base.
+func parseOfsDeltaOffset(data []byte, off int64) (int64, int64, error) {
+	start := off
+	if off >= int64(len(data)) {
+		return 0, 0, fmt.Errorf("unexpected end of data at %d", off)
+	}
+	byt := data[off]
+	off++
+
+	value := int64(byt & 0x7F)
+	for byt&0x80 != 0 {
+		if off >= int64(len(data)) {
+			return 0, 0, fmt.Errorf("unexpected end of data at %d", off)
+		}
+		byt = data[off]
+		off++
+		value = ((value + 1) << 7) | int64(byt&0x7F)
+	}
+
+	return value, off - start, nil
+}
+
+func parseVarInt(data []byte) (int64, int64, error) {
+	var shift int8
+	var off, value int64
+	for {
+		if off >= int64(len(data)) {
+			return 0, 0, fmt.Errorf(
+				"unexpected end of data at %d",
+				off,
+			)
+		}
+		byt := data[off]
+		off++
+
+		if shift > 60 {
+			return 0, 0, fmt.Errorf(
+				"object size encoding too large at %d",
+				off-1,
 			)
 		}
 		value |= int64((int64(byt & 0x7F)) << shift)
@@ -406,122 +1275,744 @@ func parseVarInt(data []byte) (int64, int64, error) {
 			break
 		}
 	}
-	return value, off, nil
+	return value, off, nil
+}
+
+func parseInstructions(data []byte) ([]Instruction, int64) {
+	off := int64(0)
+	insts := []Instruction{}
+	for off < int64(len(data)) {
+		byt := data[off]
+		off++
+
+		inst := Instruction{}
+		if byt&0x80 != 0 {
+			inst.instType = INST_TYPE_COPY
+
+			sizeBits := (byt >> 4) & 0x7
+			offsetBits := byt & 0xF
+
+			var offset int64 = 0
+			for i := 0; i < 4; i++ {
+				if (offsetBits & (1 << i)) != 0 {
+					offset |= int64(data[off]) << (8 * i)
+					off++
+				}
+			}
+
+			var size int64 = 0
+			for i := 0; i < 3; i++ {
+				if (sizeBits & (1 << i)) != 0 {
+					size |= int64(data[off]) << (8 * i)
+					off++
+				}
+			}
+
+			if size == 0 {
+				size = 0x10000
+			}
+
+			inst.offset = offset
+			inst.size = size
+
+		} else {
+			inst.instType = INST_TYPE_ADD
+			inst.size = int64(byt & 0x7F)
+			inst.data = data[off : off+inst.size]
+			off += inst.size
+		}
+		insts = append(insts, inst)
+	}
+	return insts, off
+}
+
+// parseDeltaHeader parses the source-size and target-size varints that
+// precede every delta's instruction stream, returning the offset at which
+// the instruction stream itself begins.
+func parseDeltaHeader(delta []byte) (srcSize, trgSize, off int64, err error) {
+	srcSize, read, err := parseVarInt(delta)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to parse delta source size: %w", err)
+	}
+	off = read
+
+	trgSize, read, err = parseVarInt(delta[off:])
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to parse delta target size: %w", err)
+	}
+	off += read
+
+	return srcSize, trgSize, off, nil
+}
+
+// applyDelta reconstructs a target object's content by replaying a delta's
+// COPY/ADD instruction stream (see parseInstructions) against base.
+func applyDelta(base []byte, delta []byte) ([]byte, error) {
+	srcSize, trgSize, off, err := parseDeltaHeader(delta)
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(base)) != srcSize {
+		return nil, fmt.Errorf(
+			"delta source size(%d) doesn't match source object content size(%d)",
+			srcSize, len(base),
+		)
+	}
+
+	insts, read := parseInstructions(delta[off:])
+	off += read
+
+	trgContent := []byte{}
+	for _, inst := range insts {
+		if inst.instType == INST_TYPE_COPY {
+			if inst.offset+inst.size > int64(len(base)) {
+				return nil, fmt.Errorf(
+					"instruction offset + size exceeds source content size",
+				)
+			}
+			trgContent = append(trgContent, base[inst.offset:inst.offset+inst.size]...)
+		} else {
+			if inst.size != int64(len(inst.data)) {
+				return nil, fmt.Errorf(
+					"instruction size != instruction data size",
+				)
+			}
+			trgContent = append(trgContent, inst.data...)
+		}
+	}
+
+	if int64(len(trgContent)) != trgSize {
+		return nil, fmt.Errorf(
+			"delta target size(%d) doesn't match target object content size(%d)",
+			trgSize, len(trgContent),
+		)
+	}
+
+	return trgContent, nil
+}
+
+// ObjectReader is random access to a fully-resolved object's content. It's
+// what ReaderFromDelta reads COPY spans from, so the base object never
+// needs to be sliced up front.
+type ObjectReader interface {
+	io.ReaderAt
+	Len() int64
+}
+
+type bytesObjectReader struct {
+	data []byte
+}
+
+// NewBytesObjectReader wraps an in-memory object's content as an ObjectReader.
+func NewBytesObjectReader(data []byte) ObjectReader {
+	return &bytesObjectReader{data: data}
+}
+
+func (r *bytesObjectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(r.data)) {
+		return 0, fmt.Errorf("ReadAt: offset %d out of range", off)
+	}
+	n := copy(p, r.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *bytesObjectReader) Len() int64 {
+	return int64(len(r.data))
+}
+
+func readVarIntStream(br io.ByteReader) (int64, error) {
+	var shift uint
+	var value int64
+	for {
+		byt, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if shift > 60 {
+			return 0, fmt.Errorf("object size encoding too large")
+		}
+		value |= int64(byt&0x7F) << shift
+		shift += 7
+		if byt&0x80 == 0 {
+			break
+		}
+	}
+	return value, nil
+}
+
+// deltaReader lazily walks a delta's COPY/ADD instruction stream: COPY
+// spans are read from base on demand via io.NewSectionReader, and ADD
+// bytes are read straight off the delta stream, so the reconstructed
+// target is never held in memory all at once.
+type deltaReader struct {
+	base      ObjectReader
+	br        *bufio.Reader
+	cur       io.Reader
+	remaining int64
+}
+
+// ReaderFromDelta parses a delta's source/target size header off delta and
+// returns a reader over its reconstructed target content, applied against
+// base (the already-resolved source object).
+func ReaderFromDelta(base ObjectReader, delta io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(delta)
+
+	srcSize, err := readVarIntStream(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse delta source size: %w", err)
+	}
+	if srcSize != base.Len() {
+		return nil, fmt.Errorf(
+			"delta source size(%d) doesn't match source object content size(%d)",
+			srcSize, base.Len(),
+		)
+	}
+
+	trgSize, err := readVarIntStream(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse delta target size: %w", err)
+	}
+
+	return &deltaReader{base: base, br: br, remaining: trgSize}, nil
+}
+
+func (r *deltaReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur != nil {
+			n, err := r.cur.Read(p)
+			if n > 0 {
+				r.remaining -= int64(n)
+				if r.remaining < 0 {
+					return 0, fmt.Errorf("delta produced more content than declared target size")
+				}
+				return n, nil
+			}
+			if err != nil && err != io.EOF {
+				return 0, err
+			}
+			r.cur = nil
+			continue
+		}
+
+		if r.remaining == 0 {
+			return 0, io.EOF
+		}
+
+		if err := r.advance(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// advance decodes the next COPY/ADD instruction and sets r.cur to a reader
+// over the bytes it produces.
+func (r *deltaReader) advance() error {
+	byt, err := r.br.ReadByte()
+	if err != nil {
+		return fmt.Errorf("unexpected end of delta instruction stream: %w", err)
+	}
+
+	if byt&0x80 != 0 {
+		sizeBits := (byt >> 4) & 0x7
+		offsetBits := byt & 0xF
+
+		var offset int64
+		for i := 0; i < 4; i++ {
+			if offsetBits&(1<<i) != 0 {
+				b, err := r.br.ReadByte()
+				if err != nil {
+					return fmt.Errorf("unexpected end of delta instruction stream: %w", err)
+				}
+				offset |= int64(b) << (8 * i)
+			}
+		}
+
+		var size int64
+		for i := 0; i < 3; i++ {
+			if sizeBits&(1<<i) != 0 {
+				b, err := r.br.ReadByte()
+				if err != nil {
+					return fmt.Errorf("unexpected end of delta instruction stream: %w", err)
+				}
+				size |= int64(b) << (8 * i)
+			}
+		}
+		if size == 0 {
+			size = 0x10000
+		}
+
+		if offset+size > r.base.Len() {
+			return fmt.Errorf("instruction offset + size exceeds source content size")
+		}
+		r.cur = io.NewSectionReader(r.base, offset, size)
+	} else {
+		r.cur = io.LimitReader(r.br, int64(byt&0x7F))
+	}
+
+	return nil
+}
+
+func (r *deltaReader) Close() error {
+	return nil
+}
+
+// errBaseNotReady signals that a delta's base is itself an unresolved
+// delta still waiting in resolveDeltaObjects' pending queue.
+var errBaseNotReady = fmt.Errorf("delta base not resolved yet")
+
+// resolveDeltaObjects writes every object parsePackfile produced, in the
+// process resolving ofs-delta and ref-delta entries against their base.
+// Bases are looked up in-memory, by pack offset for ofs-deltas and by sha1
+// for ref-deltas, so chains of deltas resolve without requiring an
+// intermediate base to already be written to disk; objects are retried in
+// further passes until every pending delta has a resolved base, which
+// topologically orders the resolution regardless of how the pack laid the
+// chain out. A ref-delta whose base isn't in the pack falls back to
+// readObject, covering thin packs built against objects we already have.
+func resolveDeltaObjects(objects []*PackObject) error {
+	byOffset := make(map[int64]*PackObject, len(objects))
+	byHash := make(map[string]*PackObject, len(objects))
+
+	pending := make([]*PackObject, 0, len(objects))
+	for _, obj := range objects {
+		byOffset[obj.offset] = obj
+
+		if obj.packType == OBJ_OFS_DELTA || obj.packType == OBJ_REF_DELTA {
+			pending = append(pending, obj)
+			continue
+		}
+
+		// Objects at or above LargeObjectThreshold were already streamed
+		// to disk by parsePackfile and have obj.hash set; nothing to do.
+		if obj.hash == "" {
+			hash, err := persistObject(obj.content, obj.objType)
+			if err != nil {
+				return fmt.Errorf("failed to write object: %w", err)
+			}
+			obj.hash = hash
+		}
+		byHash[obj.hash] = obj
+	}
+
+	for len(pending) > 0 {
+		next := pending[:0]
+		progressed := false
+
+		for _, obj := range pending {
+			err := resolveDeltaObject(obj, byOffset, byHash)
+			if err == errBaseNotReady {
+				next = append(next, obj)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			progressed = true
+		}
+
+		if !progressed {
+			return fmt.Errorf(
+				"failed to resolve %d delta object(s): missing or cyclic base",
+				len(next),
+			)
+		}
+		pending = next
+	}
+
+	return nil
+}
+
+// resolveDeltaObject resolves a single ofs- or ref-delta against its base
+// and writes the result, filling in obj.objType/hash (and obj.content, for
+// targets under LargeObjectThreshold) on success. Targets at or above the
+// threshold are streamed straight to disk via ReaderFromDelta/
+// writeObjectStream instead of being built up as one []byte. In packed mode
+// the threshold is ignored: the whole pack already lives in memory, and
+// resolved content stays there to be hashed rather than written loose.
+func resolveDeltaObject(obj *PackObject, byOffset map[int64]*PackObject, byHash map[string]*PackObject) error {
+	var base *PackObject
+
+	if obj.packType == OBJ_OFS_DELTA {
+		var ok bool
+		base, ok = byOffset[obj.baseOffset]
+		if !ok {
+			return fmt.Errorf("ofs-delta base not found at offset %d", obj.baseOffset)
+		}
+		if base.hash == "" {
+			return errBaseNotReady
+		}
+	} else if b, ok := byHash[obj.baseHash]; ok {
+		if b.hash == "" {
+			return errBaseNotReady
+		}
+		base = b
+	}
+
+	var baseContent []byte
+	var baseType string
+	if base != nil {
+		baseType = base.objType
+		baseContent = base.content
+		if baseContent == nil {
+			// base was streamed straight to disk (large object, or a
+			// ref-delta base looked up before this run started).
+			content, _, err := readObject(base.hash)
+			if err != nil {
+				return fmt.Errorf("failed to read base object %s: %w", base.hash, err)
+			}
+			baseContent = content
+		}
+	} else {
+		content, objType, err := readObject(obj.baseHash)
+		if err != nil {
+			return fmt.Errorf(
+				"ref-delta base %s not found in pack or on disk: %w",
+				obj.baseHash, err,
+			)
+		}
+		baseContent, baseType = content, objType
+	}
+
+	srcSize, trgSize, _, err := parseDeltaHeader(obj.payload)
+	if err != nil {
+		return err
+	}
+	if int64(len(baseContent)) != srcSize {
+		return fmt.Errorf(
+			"delta source size(%d) doesn't match source object content size(%d)",
+			srcSize, len(baseContent),
+		)
+	}
+
+	if trgSize < LargeObjectThreshold || StorageMode == "packed" {
+		trgContent, err := applyDelta(baseContent, obj.payload)
+		if err != nil {
+			return err
+		}
+
+		hash, err := persistObject(trgContent, baseType)
+		if err != nil {
+			return fmt.Errorf("failed to write object: %w", err)
+		}
+		obj.content = trgContent
+		obj.objType = baseType
+		obj.hash = hash
+		byHash[hash] = obj
+		return nil
+	}
+
+	r, err := ReaderFromDelta(NewBytesObjectReader(baseContent), bytes.NewReader(obj.payload))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	hash, err := writeObjectStream(r, baseType, trgSize)
+	if err != nil {
+		return err
+	}
+	obj.objType = baseType
+	obj.hash = hash
+	byHash[hash] = obj
+
+	return nil
 }
 
-func parseInstructions(data []byte) ([]Instruction, int64) {
-	off := int64(0)
-	insts := []Instruction{}
-	for off < int64(len(data)) {
-		byt := data[off]
-		off++
+// idxMagic is the 4-byte signature at the start of a v2 pack .idx file.
+const idxMagic = "\xfftOc"
+
+// packIndex is a parsed v2 .idx: a 256-entry fanout table (cumulative object
+// counts by the first byte of their sha1) followed by the sorted sha1 names,
+// their CRC32s and their pack offsets, letting findOffset locate any object
+// in the companion .pack file with a binary search instead of a linear scan.
+type packIndex struct {
+	fanout     [256]uint32
+	names      []byte // sorted, 20 bytes per entry
+	crcs       []uint32
+	offsets    []uint32
+	extOffsets []int64
+}
 
-		inst := Instruction{}
-		if byt&0x80 != 0 {
-			inst.instType = INST_TYPE_COPY
+// writePackFile writes the received pack verbatim to
+// .git/objects/pack/pack-<sha>.pack, named after its own trailing checksum,
+// and returns that checksum as a hex string.
+func writePackFile(pack []byte) (string, error) {
+	packHash := hex.EncodeToString(pack[len(pack)-20:])
 
-			sizeBits := (byt >> 4) & 0x7
-			offsetBits := byt & 0xF
+	packDir := filepath.Join(".git", "objects", "pack")
+	if err := os.MkdirAll(packDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", packDir, err)
+	}
 
-			var offset int64 = 0
-			for i := 0; i < 4; i++ {
-				if (offsetBits & (1 << i)) != 0 {
-					offset |= int64(data[off]) << (8 * i)
-					off++
-				}
-			}
+	packPath := filepath.Join(packDir, fmt.Sprintf("pack-%s.pack", packHash))
+	if err := os.WriteFile(packPath, pack, 0644); err != nil {
+		return "", fmt.Errorf("failed to write to %s: %w", packPath, err)
+	}
 
-			var size int64 = 0
-			for i := 0; i < 3; i++ {
-				if (sizeBits & (1 << i)) != 0 {
-					size |= int64(data[off]) << (8 * i)
-					off++
-				}
-			}
+	return packHash, nil
+}
 
-			if size == 0 {
-				size = 0x10000
-			}
+// writePackIndex writes the v2 .idx file matching pack-<packHash>.pack:
+// magic, version, a fanout table, sorted sha1 names, their CRC32s (computed
+// by parsePackfile over each entry's packed bytes), their offsets into the
+// pack (extended to an 8-byte table, flagged by a set MSB, for offsets past
+// 2 GiB), the pack's own trailing checksum, and a trailing checksum of the
+// idx file itself.
+func writePackIndex(packHash string, objects []*PackObject) error {
+	sorted := make([]*PackObject, len(objects))
+	copy(sorted, objects)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].hash < sorted[j].hash })
 
-			inst.offset = offset
-			inst.size = size
+	var buf bytes.Buffer
+	buf.WriteString(idxMagic)
+	binary.Write(&buf, binary.BigEndian, uint32(2))
+
+	var fanout [256]uint32
+	for _, obj := range sorted {
+		hashBytes, err := hex.DecodeString(obj.hash)
+		if err != nil {
+			return fmt.Errorf("invalid object hash %s: %w", obj.hash, err)
+		}
+		fanout[hashBytes[0]]++
+	}
+	for i := 1; i < 256; i++ {
+		fanout[i] += fanout[i-1]
+	}
+	for _, count := range fanout {
+		binary.Write(&buf, binary.BigEndian, count)
+	}
+
+	for _, obj := range sorted {
+		hashBytes, _ := hex.DecodeString(obj.hash)
+		buf.Write(hashBytes)
+	}
+
+	for _, obj := range sorted {
+		binary.Write(&buf, binary.BigEndian, obj.crc32)
+	}
 
+	// obj.offset is relative to the pack body after parsePackfile strips the
+	// 12-byte header; the idx stores offsets from the start of the pack file.
+	const packHeaderLen = 12
+	var extOffsets []int64
+	for _, obj := range sorted {
+		absOffset := obj.offset + packHeaderLen
+		if absOffset > 0x7FFFFFFF {
+			binary.Write(&buf, binary.BigEndian, uint32(len(extOffsets))|0x80000000)
+			extOffsets = append(extOffsets, absOffset)
 		} else {
-			inst.instType = INST_TYPE_ADD
-			inst.size = int64(byt & 0x7F)
-			inst.data = data[off : off+inst.size]
-			off += inst.size
+			binary.Write(&buf, binary.BigEndian, uint32(absOffset))
 		}
-		insts = append(insts, inst)
 	}
-	return insts, off
+	for _, offset := range extOffsets {
+		binary.Write(&buf, binary.BigEndian, uint64(offset))
+	}
+
+	packHashBytes, err := hex.DecodeString(packHash)
+	if err != nil {
+		return fmt.Errorf("invalid pack hash %s: %w", packHash, err)
+	}
+	buf.Write(packHashBytes)
+
+	hasher := sha1.New()
+	hasher.Write(buf.Bytes())
+	buf.Write(hasher.Sum(nil))
+
+	idxPath := filepath.Join(".git", "objects", "pack", fmt.Sprintf("pack-%s.idx", packHash))
+	if err := os.WriteFile(idxPath, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write to %s: %w", idxPath, err)
+	}
+
+	return nil
 }
 
-func processRefDeltaObjs(deltas []Delta) error {
-	for _, d := range deltas {
-		off := int64(0)
-		srcSize, read, err := parseVarInt(d.data[off:])
-		if err != nil {
-			return fmt.Errorf("failed to parse delta source size: %w", err)
-		}
-		off += read
-		trgSize, read, err := parseVarInt(d.data[off:])
-		if err != nil {
-			return fmt.Errorf("failed to parse delta target size: %w", err)
-		}
-		off += read
+// loadPackIndex parses a v2 .idx file from disk.
+func loadPackIndex(path string) (*packIndex, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if len(data) < 8 || string(data[:4]) != idxMagic {
+		return nil, fmt.Errorf("%s is not a v2 pack idx file", path)
+	}
+	if version := binary.BigEndian.Uint32(data[4:8]); version != 2 {
+		return nil, fmt.Errorf("unsupported pack idx version %d in %s", version, path)
+	}
 
-		srcContent, objType, err := readObject(d.hash)
-		if err != nil {
-			return err
-		}
+	off := 8
+	pi := &packIndex{}
+	for i := 0; i < 256; i++ {
+		pi.fanout[i] = binary.BigEndian.Uint32(data[off : off+4])
+		off += 4
+	}
 
-		if int64(len(srcContent)) != srcSize {
-			return fmt.Errorf(
-				"delta source size(%d) doesn't match source object content size(%d)",
-				srcSize, len(srcContent),
-			)
+	total := int(pi.fanout[255])
+
+	pi.names = data[off : off+total*20]
+	off += total * 20
+
+	pi.crcs = make([]uint32, total)
+	for i := 0; i < total; i++ {
+		pi.crcs[i] = binary.BigEndian.Uint32(data[off : off+4])
+		off += 4
+	}
+
+	pi.offsets = make([]uint32, total)
+	for i := 0; i < total; i++ {
+		pi.offsets[i] = binary.BigEndian.Uint32(data[off : off+4])
+		off += 4
+	}
+
+	numExt := 0
+	for _, o := range pi.offsets {
+		if o&0x80000000 != 0 {
+			numExt++
 		}
+	}
+	pi.extOffsets = make([]int64, numExt)
+	for i := 0; i < numExt; i++ {
+		pi.extOffsets[i] = int64(binary.BigEndian.Uint64(data[off : off+8]))
+		off += 8
+	}
 
-		insts, read := parseInstructions(d.data[off:])
-		off += read
+	return pi, nil
+}
 
-		trgContent := []byte{}
-		for _, inst := range insts {
-			if inst.instType == INST_TYPE_COPY {
-				if inst.offset+inst.size > int64(len(srcContent)) {
-					return fmt.Errorf(
-						"instruction offset + size exceeds source content size",
-					)
-				}
-				trgContent = append(trgContent,
-					srcContent[inst.offset:inst.offset+inst.size]...)
-			} else {
-				if inst.size != int64(len(inst.data)) {
-					return fmt.Errorf(
-						"instruction size != instruction data size",
-					)
-				}
-				trgContent = append(trgContent, inst.data...)
+// findOffset binary-searches the fanout+names table for hash's pack offset.
+func (pi *packIndex) findOffset(hash string) (int64, bool) {
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil || len(hashBytes) != 20 {
+		return 0, false
+	}
+
+	lo := 0
+	if hashBytes[0] > 0 {
+		lo = int(pi.fanout[hashBytes[0]-1])
+	}
+	hi := int(pi.fanout[hashBytes[0]])
+
+	for lo < hi {
+		mid := (lo + hi) / 2
+		switch bytes.Compare(pi.names[mid*20:mid*20+20], hashBytes) {
+		case 0:
+			offset := uint64(pi.offsets[mid])
+			if pi.offsets[mid]&0x80000000 != 0 {
+				return pi.extOffsets[pi.offsets[mid]&0x7FFFFFFF], true
 			}
+			return int64(offset), true
+		case -1:
+			lo = mid + 1
+		default:
+			hi = mid
 		}
+	}
 
-		if int64(len(trgContent)) != trgSize {
-			return fmt.Errorf(
-				"delta target size(%d) doesn't match target object content size(%d)",
-				trgSize, len(trgContent),
-			)
-		}
+	return 0, false
+}
 
-		err = writeObject(trgContent, objType)
-		if err != nil {
-			return err
-		}
+// cachedPack and cachedPackIndex hold the single pack/idx pair readObject
+// resolves objects from in packed mode, lazily loaded on first use.
+var cachedPack []byte
+var cachedPackIndex *packIndex
 
+// loadPackStore lazily loads the repo's single pack and its idx, populating
+// cachedPack/cachedPackIndex.
+func loadPackStore() error {
+	if cachedPack != nil && cachedPackIndex != nil {
+		return nil
 	}
+
+	matches, err := filepath.Glob(filepath.Join(".git", "objects", "pack", "*.idx"))
+	if err != nil {
+		return fmt.Errorf("failed to list pack idx files: %w", err)
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("no pack idx file found under .git/objects/pack")
+	}
+
+	idx, err := loadPackIndex(matches[0])
+	if err != nil {
+		return err
+	}
+
+	packPath := strings.TrimSuffix(matches[0], ".idx") + ".pack"
+	pack, err := os.ReadFile(packPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", packPath, err)
+	}
+
+	cachedPackIndex = idx
+	cachedPack = pack
 	return nil
 }
 
+// readObjectFromPackStore looks hash up in the repo's pack idx and decodes
+// it straight out of the pack file, resolving ofs/ref-delta chains on the
+// fly via readPackObjectAt. This is readObject's packed-mode counterpart.
+func readObjectFromPackStore(hash string) ([]byte, string, error) {
+	if err := loadPackStore(); err != nil {
+		return nil, "", err
+	}
+
+	offset, ok := cachedPackIndex.findOffset(hash)
+	if !ok {
+		return nil, "", fmt.Errorf("object %s not found in pack index", hash)
+	}
+
+	return readPackObjectAt(cachedPack, cachedPackIndex, offset)
+}
+
+// readPackObjectAt decodes the object entry at offset (counted from the
+// start of the pack file, header included) the same way parsePackfile does,
+// then, for ofs/ref-delta entries, recurses onto the base (by offset or, for
+// a ref-delta, by looking its hash up in idx) and applies the delta, so the
+// caller always gets back fully resolved content.
+func readPackObjectAt(pack []byte, idx *packIndex, offset int64) ([]byte, string, error) {
+	hdr, off, err := parsePackEntryHeader(pack, offset)
+	if err != nil {
+		return nil, "", err
+	}
+
+	zlibReader, err := zlib.NewReader(bytes.NewReader(pack[off:]))
+	if err != nil {
+		return nil, "", fmt.Errorf("zlib.NewReader has failed: %v", err)
+	}
+	raw, err := io.ReadAll(zlibReader)
+	zlibReader.Close()
+	if err != nil {
+		return nil, "", fmt.Errorf("io.ReadAll has failed: %v", err)
+	}
+
+	if hdr.objType != OBJ_REF_DELTA && hdr.objType != OBJ_OFS_DELTA {
+		return raw, objTypeNames[hdr.objType], nil
+	}
+
+	baseOffset := hdr.baseOffset
+	if hdr.objType == OBJ_REF_DELTA {
+		var ok bool
+		baseOffset, ok = idx.findOffset(hdr.baseHash)
+		if !ok {
+			return nil, "", fmt.Errorf("ref-delta base %s not found in pack index", hdr.baseHash)
+		}
+	}
+
+	baseContent, baseType, err := readPackObjectAt(pack, idx, baseOffset)
+	if err != nil {
+		return nil, "", err
+	}
+
+	content, err := applyDelta(baseContent, raw)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return content, baseType, nil
+}
+
 func changeDir(dirPath string) error {
 	err := os.MkdirAll(dirPath, 0755)
 	if err != nil {
@@ -565,27 +2056,293 @@ func initRepo(mainHash, defaultBranch string) error {
 	return nil
 }
 
+// TreeEntry is one line of a decoded tree object: "<mode> <name>\0<20-byte sha1>".
+type TreeEntry struct {
+	mode string
+	name string
+	hash string
+}
+
+func parseTreeEntries(content []byte) ([]TreeEntry, error) {
+	entries := []TreeEntry{}
+
+	off := 0
+	for off < len(content) {
+		spaceIdx := bytes.IndexByte(content[off:], ' ')
+		if spaceIdx == -1 {
+			return nil, fmt.Errorf("failed to find space byte in tree entry")
+		}
+		mode := string(content[off : off+spaceIdx])
+		off += spaceIdx + 1
+
+		nullIdx := bytes.IndexByte(content[off:], 0)
+		if nullIdx == -1 {
+			return nil, fmt.Errorf("failed to find null byte in tree entry")
+		}
+		name := string(content[off : off+nullIdx])
+		off += nullIdx + 1
+
+		if off+20 > len(content) {
+			return nil, fmt.Errorf("unexpected end of tree content")
+		}
+		hash := hex.EncodeToString(content[off : off+20])
+		off += 20
+
+		entries = append(entries, TreeEntry{mode: mode, name: name, hash: hash})
+	}
+
+	return entries, nil
+}
+
+// IndexEntry is the subset of a .git/index entry writeIndex needs: every
+// other field (ctime, mtime, dev, ino, uid, gid) is written as zero, which
+// git accepts and treats as "unknown, always restat".
+type IndexEntry struct {
+	mode uint32
+	hash string
+	path string
+	size int64
+}
+
+// checkoutTree recursively writes the working-tree files for the tree at
+// hash under dirPath (relative to the repo root, "" for the root itself),
+// returning an IndexEntry for every blob it wrote.
+func checkoutTree(hash, dirPath string) ([]IndexEntry, error) {
+	content, objType, err := readObject(hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tree object %s: %w", hash, err)
+	}
+	if objType != "tree" {
+		return nil, fmt.Errorf("expected tree object at %s, got %s", hash, objType)
+	}
+
+	treeEntries, err := parseTreeEntries(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tree %s: %w", hash, err)
+	}
+
+	indexEntries := []IndexEntry{}
+	for _, e := range treeEntries {
+		entryPath := filepath.Join(dirPath, e.name)
+
+		if e.mode == "40000" {
+			if err := os.MkdirAll(entryPath, 0755); err != nil {
+				return nil, fmt.Errorf("failed to create %s: %w", entryPath, err)
+			}
+			subEntries, err := checkoutTree(e.hash, entryPath)
+			if err != nil {
+				return nil, err
+			}
+			indexEntries = append(indexEntries, subEntries...)
+			continue
+		}
+
+		// A gitlink points at a commit in the submodule's own repo, not an
+		// object in this pack, so it can't be read here: leave the
+		// submodule directory un-initialized, same as a bare `git clone`.
+		if e.mode == "160000" {
+			mode, err := strconv.ParseUint(e.mode, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tree entry mode %s: %w", e.mode, err)
+			}
+			indexEntries = append(indexEntries, IndexEntry{
+				mode: uint32(mode),
+				hash: e.hash,
+				path: entryPath,
+				size: 0,
+			})
+			continue
+		}
+
+		entryContent, _, err := readObject(e.hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read blob %s: %w", e.hash, err)
+		}
+
+		switch e.mode {
+		case "120000":
+			if err := os.Symlink(string(entryContent), entryPath); err != nil {
+				return nil, fmt.Errorf("failed to symlink %s: %w", entryPath, err)
+			}
+		case "100644", "100755":
+			perm := os.FileMode(0644)
+			if e.mode == "100755" {
+				perm = 0755
+			}
+			if err := os.WriteFile(entryPath, entryContent, perm); err != nil {
+				return nil, fmt.Errorf("failed to write %s: %w", entryPath, err)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported tree entry mode %s for %s", e.mode, entryPath)
+		}
+
+		mode, err := strconv.ParseUint(e.mode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tree entry mode %s: %w", e.mode, err)
+		}
+		indexEntries = append(indexEntries, IndexEntry{
+			mode: uint32(mode),
+			hash: e.hash,
+			path: entryPath,
+			size: int64(len(entryContent)),
+		})
+	}
+
+	return indexEntries, nil
+}
+
+// writeIndex writes entries as a minimal v2 .git/index: a 12-byte header,
+// sorted entries with all timestamps/dev/ino/uid/gid zeroed (git treats
+// that as "unknown, always restat"), and a trailing sha1 of the whole file.
+func writeIndex(entries []IndexEntry) error {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+
+	var buf bytes.Buffer
+	buf.WriteString("DIRC")
+	binary.Write(&buf, binary.BigEndian, uint32(2))
+	binary.Write(&buf, binary.BigEndian, uint32(len(entries)))
+
+	for _, e := range entries {
+		hashBytes, err := hex.DecodeString(e.hash)
+		if err != nil {
+			return fmt.Errorf("invalid object hash %s: %w", e.hash, err)
+		}
+
+		entryStart := buf.Len()
+
+		// ctime, mtime, dev, ino
+		binary.Write(&buf, binary.BigEndian, [6]uint32{})
+		binary.Write(&buf, binary.BigEndian, e.mode)
+		// uid, gid
+		binary.Write(&buf, binary.BigEndian, [2]uint32{})
+		binary.Write(&buf, binary.BigEndian, uint32(e.size))
+		buf.Write(hashBytes)
+
+		nameLen := len(e.path)
+		flags := uint16(nameLen)
+		if nameLen > 0xFFF {
+			flags = 0xFFF
+		}
+		binary.Write(&buf, binary.BigEndian, flags)
+
+		buf.WriteString(e.path)
+		buf.WriteByte(0)
+		for (buf.Len()-entryStart)%8 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+
+	hasher := sha1.New()
+	hasher.Write(buf.Bytes())
+	buf.Write(hasher.Sum(nil))
+
+	indexPath := filepath.Join(".git", "index")
+	if err := os.WriteFile(indexPath, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write to %s: %w", indexPath, err)
+	}
+	return nil
+}
+
+// checkout materializes the working tree for the commit at mainHash and
+// writes a matching .git/index, so a clone leaves behind what `git status`
+// considers a clean checkout instead of just loose objects and a ref.
+func checkout(mainHash string) error {
+	content, objType, err := readObject(mainHash)
+	if err != nil {
+		return fmt.Errorf("failed to read commit object %s: %w", mainHash, err)
+	}
+	if objType != "commit" {
+		return fmt.Errorf("expected commit object at %s, got %s", mainHash, objType)
+	}
+
+	treeHash := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "tree ") {
+			treeHash = strings.TrimPrefix(line, "tree ")
+			break
+		}
+	}
+	if treeHash == "" {
+		return fmt.Errorf("commit %s has no tree field", mainHash)
+	}
+
+	entries, err := checkoutTree(treeHash, "")
+	if err != nil {
+		return fmt.Errorf("failed to checkout tree %s: %w", treeHash, err)
+	}
+
+	return writeIndex(entries)
+}
+
 func main() {
-	if len(os.Args) != 3 {
-		fmt.Fprintf(os.Stderr, "%s <repo_url> <dir_path>\n", os.Args[0])
+	if len(os.Args) < 3 {
+		fmt.Fprintf(os.Stderr, "%s <repo_url> <dir_path> [--packed] [-depth N] [-i keyfile]\n", os.Args[0])
 		os.Exit(1)
 	}
 
 	repoURL := os.Args[1]
 	dirPath := os.Args[2]
 
+	depth := 0
+	identityFile := ""
+	flagArgs := os.Args[3:]
+	for i := 0; i < len(flagArgs); i++ {
+		switch flagArgs[i] {
+		case "--packed":
+			StorageMode = "packed"
+		case "-depth":
+			if i+1 >= len(flagArgs) {
+				fmt.Fprintln(os.Stderr, "-depth requires a value")
+				os.Exit(1)
+			}
+			d, err := strconv.Atoi(flagArgs[i+1])
+			if err != nil || d <= 0 {
+				fmt.Fprintf(os.Stderr, "invalid -depth value %q\n", flagArgs[i+1])
+				os.Exit(1)
+			}
+			depth = d
+			i++
+		case "-i":
+			if i+1 >= len(flagArgs) {
+				fmt.Fprintln(os.Stderr, "-i requires a keyfile path")
+				os.Exit(1)
+			}
+			identityFile = flagArgs[i+1]
+			i++
+		default:
+			fmt.Fprintf(os.Stderr, "unknown flag %q\n", flagArgs[i])
+			os.Exit(1)
+		}
+	}
+
+	var transport Transport
+	switch {
+	case strings.HasPrefix(repoURL, "http://"), strings.HasPrefix(repoURL, "https://"):
+		transport = NewHTTPTransport(repoURL)
+	case strings.HasPrefix(repoURL, "ssh://"), isSCPLikeSSH(repoURL):
+		sshTransport, err := NewSSHTransport(repoURL, identityFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		transport = sshTransport
+	default:
+		fmt.Fprintf(os.Stderr, "unrecognized repo URL %q\n", repoURL)
+		os.Exit(1)
+	}
+
 	if err := changeDir(dirPath); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	mainHash, defaultBranch, err := getMainHash(repoURL)
+	mainHash, defaultBranch, err := getMainHash(transport)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	pack, err := getPackfile(repoURL, mainHash)
+	pack, shallowHashes, err := getPackfile(transport, mainHash, depth)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -596,15 +2353,37 @@ func main() {
 		os.Exit(1)
 	}
 
-	deltas, err := parsePackfile(pack)
+	if err := writeShallowFile(shallowHashes); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	objects, err := parsePackfile(pack)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	err = processRefDeltaObjs(deltas)
+	err = resolveDeltaObjects(objects)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+
+	if StorageMode == "packed" {
+		packHash, err := writePackFile(pack)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := writePackIndex(packHash, objects); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if err := checkout(mainHash); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPktLineRoundTrip(t *testing.T) {
+	line := encodePktLine("want abc\n")
+
+	payload, flush, next, err := readPktLine([]byte(line), 0)
+	if err != nil {
+		t.Fatalf("readPktLine: %v", err)
+	}
+	if flush {
+		t.Fatal("expected a non-flush pkt-line")
+	}
+	if string(payload) != "want abc\n" {
+		t.Fatalf("payload = %q", payload)
+	}
+	if next != len(line) {
+		t.Fatalf("next = %d, want %d", next, len(line))
+	}
+}
+
+func TestReadPktLineFlush(t *testing.T) {
+	_, flush, next, err := readPktLine([]byte("0000"), 0)
+	if err != nil {
+		t.Fatalf("readPktLine: %v", err)
+	}
+	if !flush {
+		t.Fatal("expected a flush-pkt")
+	}
+	if next != 4 {
+		t.Fatalf("next = %d, want 4", next)
+	}
+}
+
+func TestParseUploadPackResponseWithShallowAndSideband(t *testing.T) {
+	var body bytes.Buffer
+	body.WriteString(encodePktLine("shallow aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa\n"))
+	body.WriteString("0000")
+	body.WriteString(encodePktLine("NAK\n"))
+	body.WriteString(encodePktLine(string([]byte{1}) + "PACKDATA"))
+	body.WriteString(encodePktLine(string([]byte{2}) + "progress, ignored"))
+	body.WriteString("0000")
+
+	pack, shallows, err := parseUploadPackResponse(body.Bytes())
+	if err != nil {
+		t.Fatalf("parseUploadPackResponse: %v", err)
+	}
+	if len(shallows) != 1 || shallows[0] != "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa" {
+		t.Fatalf("shallows = %v", shallows)
+	}
+	if string(pack) != "PACKDATA" {
+		t.Fatalf("pack = %q", pack)
+	}
+}
+
+func TestParseUploadPackResponseSidebandError(t *testing.T) {
+	var body bytes.Buffer
+	body.WriteString(encodePktLine("NAK\n"))
+	body.WriteString(encodePktLine(string([]byte{3}) + "fatal: no such ref"))
+
+	if _, _, err := parseUploadPackResponse(body.Bytes()); err == nil {
+		t.Fatal("expected an error from sideband channel 3")
+	}
+}
+
+func TestParseRefAdvertisement(t *testing.T) {
+	var body bytes.Buffer
+	body.WriteString(encodePktLine(
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa HEAD\x00symref=HEAD:refs/heads/main agent=git/2.43\n"))
+	body.WriteString(encodePktLine(
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa refs/heads/main\n"))
+	body.WriteString(encodePktLine(
+		"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb refs/heads/other\n"))
+	body.WriteString("0000")
+
+	refs, capabilities, err := parseRefAdvertisement(body.Bytes())
+	if err != nil {
+		t.Fatalf("parseRefAdvertisement: %v", err)
+	}
+	if refs["refs/heads/main"] != "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa" {
+		t.Fatalf("refs[refs/heads/main] = %q", refs["refs/heads/main"])
+	}
+	if refs["refs/heads/other"] != "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb" {
+		t.Fatalf("refs[refs/heads/other] = %q", refs["refs/heads/other"])
+	}
+	found := false
+	for _, c := range capabilities {
+		if c == "symref=HEAD:refs/heads/main" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("capabilities = %v, missing symref", capabilities)
+	}
+}
+
+func TestBuildUploadPackRequest(t *testing.T) {
+	body := buildUploadPackRequest([]string{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}, nil, UploadPackOptions{Depth: 5})
+
+	payload, _, next, err := readPktLine([]byte(body), 0)
+	if err != nil {
+		t.Fatalf("readPktLine(want): %v", err)
+	}
+	wantLine := "want aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa shallow ofs-delta side-band-64k agent=" + gcloneAgent + "\n"
+	if string(payload) != wantLine {
+		t.Fatalf("want line = %q, want %q", payload, wantLine)
+	}
+
+	payload, _, next, err = readPktLine([]byte(body), next)
+	if err != nil {
+		t.Fatalf("readPktLine(deepen): %v", err)
+	}
+	if string(payload) != "deepen 5\n" {
+		t.Fatalf("deepen line = %q", payload)
+	}
+
+	if body[next:next+4] != "0000" {
+		t.Fatalf("expected a flush-pkt after the want/deepen lines, got %q", body[next:next+4])
+	}
+}
+
+func TestParseSSHURL(t *testing.T) {
+	cases := []struct {
+		url, user, host, port, path string
+	}{
+		{"git@example.com:org/repo.git", "git", "example.com", "22", "org/repo.git"},
+		{"ssh://user@example.com:2222/org/repo.git", "user", "example.com", "2222", "org/repo.git"},
+	}
+	for _, c := range cases {
+		user, host, port, path, err := parseSSHURL(c.url)
+		if err != nil {
+			t.Fatalf("parseSSHURL(%q): %v", c.url, err)
+		}
+		if user != c.user || host != c.host || port != c.port || path != c.path {
+			t.Fatalf("parseSSHURL(%q) = %q,%q,%q,%q, want %q,%q,%q,%q",
+				c.url, user, host, port, path, c.user, c.host, c.port, c.path)
+		}
+	}
+}
+
+func TestIsSCPLikeSSH(t *testing.T) {
+	cases := []struct {
+		url  string
+		want bool
+	}{
+		{"git@example.com:org/repo.git", true},
+		{"ssh://example.com/org/repo.git", false},
+		{"https://example.com/org/repo.git", false},
+	}
+	for _, c := range cases {
+		if got := isSCPLikeSSH(c.url); got != c.want {
+			t.Fatalf("isSCPLikeSSH(%q) = %v, want %v", c.url, got, c.want)
+		}
+	}
+}
+
+// encodeDeltaVarint is the inverse of parseVarInt/readVarIntStream: a
+// little-endian base-128 varint with the MSB as a continuation bit.
+func encodeDeltaVarint(v int64) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7F)
+		v >>= 7
+		if v != 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if v == 0 {
+			break
+		}
+	}
+	return out
+}
+
+// buildCopyWholeBaseDelta builds a ref-delta payload that reconstructs
+// base+tail by COPYing all of base (offset 0, size len(base)) then ADDing
+// tail, in the instruction encoding parseInstructions expects.
+func buildCopyWholeBaseDelta(base, tail []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(encodeDeltaVarint(int64(len(base))))
+	buf.Write(encodeDeltaVarint(int64(len(base) + len(tail))))
+
+	// COPY: offsetBits=0 (offset 0, no offset bytes), sizeBits=0b111 (all
+	// three size bytes present).
+	size := len(base)
+	buf.WriteByte(0x80 | (0x7 << 4))
+	buf.WriteByte(byte(size))
+	buf.WriteByte(byte(size >> 8))
+	buf.WriteByte(byte(size >> 16))
+
+	buf.WriteByte(byte(len(tail)))
+	buf.Write(tail)
+
+	return buf.Bytes()
+}
+
+// benchmarkResolveRefDeltas resolves a batch of ref-deltas that all point at
+// the same base object, which is already on disk but not part of the
+// current batch — the thin-pack situation processRefDeltaObjs hits on every
+// real clone where a delta's base was itself resolved earlier. ObjectCache
+// is reset per b.N iteration so every run pays exactly one cold base read.
+func benchmarkResolveRefDeltas(b *testing.B, cacheBudget int64) {
+	dir := b.TempDir()
+	origDir, err := os.Getwd()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Chdir(origDir)
+	if err := os.Chdir(dir); err != nil {
+		b.Fatal(err)
+	}
+	if err := os.MkdirAll(".git/objects", 0755); err != nil {
+		b.Fatal(err)
+	}
+
+	base := make([]byte, 256<<10)
+	for i := range base {
+		base[i] = byte(i)
+	}
+	baseHash, err := writeObject(base, "blob")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	const numDeltas = 300
+	payload := buildCopyWholeBaseDelta(base, []byte("tail"))
+
+	origCache := ObjectCache
+	defer func() { ObjectCache = origCache }()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ObjectCache = NewBufferLRU(cacheBudget)
+
+		objects := make([]*PackObject, numDeltas)
+		for j := range objects {
+			objects[j] = &PackObject{
+				offset:   int64(j),
+				packType: OBJ_REF_DELTA,
+				baseHash: baseHash,
+				payload:  payload,
+			}
+		}
+		if err := resolveDeltaObjects(objects); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestBufferLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewBufferLRU(10)
+	c.Put("a", []byte("1234"), "blob")
+	c.Put("b", []byte("1234"), "blob")
+	if _, _, ok := c.Get("a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+	// a was just touched, so the next Put evicts b, not a.
+	c.Put("c", []byte("1234"), "blob")
+	if _, _, ok := c.Get("b"); ok {
+		t.Fatal("expected b to have been evicted")
+	}
+	if _, _, ok := c.Get("a"); !ok {
+		t.Fatal("expected a to survive eviction")
+	}
+	if _, _, ok := c.Get("c"); !ok {
+		t.Fatal("expected c to be cached")
+	}
+}
+
+func TestBufferLRUZeroBudgetDisablesCache(t *testing.T) {
+	c := NewBufferLRU(0)
+	c.Put("a", []byte("1234"), "blob")
+	if _, _, ok := c.Get("a"); ok {
+		t.Fatal("expected a zero-budget cache to never hit")
+	}
+}
+
+func TestBufferLRURejectsEntryLargerThanBudget(t *testing.T) {
+	c := NewBufferLRU(2)
+	c.Put("a", []byte("1234"), "blob")
+	if _, _, ok := c.Get("a"); ok {
+		t.Fatal("expected an entry larger than the budget to be rejected")
+	}
+}
+
+// buildTreeContent encodes entries in the git tree format parseTreeEntries
+// expects: "<mode> <name>\0<20-byte sha1>" back to back.
+func buildTreeContent(entries []TreeEntry) []byte {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		buf.WriteString(e.mode)
+		buf.WriteByte(' ')
+		buf.WriteString(e.name)
+		buf.WriteByte(0)
+		hashBytes, _ := hex.DecodeString(e.hash)
+		buf.Write(hashBytes)
+	}
+	return buf.Bytes()
+}
+
+// TestCheckoutTreeSkipsGitlinks checks out a tree containing a regular blob
+// alongside a 160000 gitlink (submodule) entry, whose hash points at a
+// commit in another repo and can't be resolved against this pack: the
+// gitlink must be recorded in the index without attempting to read or
+// write any content for it.
+func TestCheckoutTreeSkipsGitlinks(t *testing.T) {
+	dir := t.TempDir()
+	origDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(origDir)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(".git/objects", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	blobHash, err := writeObject([]byte("hello"), "blob")
+	if err != nil {
+		t.Fatalf("writeObject: %v", err)
+	}
+	const gitlinkHash = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+
+	treeContent := buildTreeContent([]TreeEntry{
+		{mode: "100644", name: "file.txt", hash: blobHash},
+		{mode: "160000", name: "submodule", hash: gitlinkHash},
+	})
+	treeHash, err := writeObject(treeContent, "tree")
+	if err != nil {
+		t.Fatalf("writeObject(tree): %v", err)
+	}
+
+	entries, err := checkoutTree(treeHash, "")
+	if err != nil {
+		t.Fatalf("checkoutTree: %v", err)
+	}
+
+	if _, err := os.Stat("submodule"); err == nil {
+		t.Fatal("expected no submodule directory/file to be created")
+	}
+
+	var gotFile, gotGitlink bool
+	for _, e := range entries {
+		switch e.path {
+		case "file.txt":
+			gotFile = true
+			if e.hash != blobHash {
+				t.Fatalf("file.txt hash = %s, want %s", e.hash, blobHash)
+			}
+		case "submodule":
+			gotGitlink = true
+			if e.hash != gitlinkHash {
+				t.Fatalf("submodule hash = %s, want %s", e.hash, gitlinkHash)
+			}
+			if e.size != 0 {
+				t.Fatalf("submodule size = %d, want 0", e.size)
+			}
+		}
+	}
+	if !gotFile {
+		t.Fatal("missing index entry for file.txt")
+	}
+	if !gotGitlink {
+		t.Fatal("missing index entry for submodule")
+	}
+}
+
+// TestWriteIndexSortsAndChecksums writes two out-of-order entries and checks
+// that writeIndex sorts them by path, writes the DIRC v2 header with the
+// right entry count, and appends a trailing sha1 of everything before it.
+func TestWriteIndexSortsAndChecksums(t *testing.T) {
+	dir := t.TempDir()
+	origDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(origDir)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(".git", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := []IndexEntry{
+		{mode: 0100644, hash: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", path: "z.txt", size: 4},
+		{mode: 0100644, hash: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", path: "a.txt", size: 5},
+	}
+	if err := writeIndex(entries); err != nil {
+		t.Fatalf("writeIndex: %v", err)
+	}
+
+	data, err := os.ReadFile(".git/index")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if string(data[:4]) != "DIRC" {
+		t.Fatalf("signature = %q, want DIRC", data[:4])
+	}
+	if version := binary.BigEndian.Uint32(data[4:8]); version != 2 {
+		t.Fatalf("version = %d, want 2", version)
+	}
+	if count := binary.BigEndian.Uint32(data[8:12]); count != 2 {
+		t.Fatalf("entry count = %d, want 2", count)
+	}
+
+	hasher := sha1.New()
+	hasher.Write(data[:len(data)-20])
+	if got, want := data[len(data)-20:], hasher.Sum(nil); !bytes.Equal(got, want) {
+		t.Fatalf("trailing checksum = %x, want %x", got, want)
+	}
+
+	// a.txt sorts before z.txt, so its entry comes first: 12-byte header,
+	// then ctime/mtime/dev/ino (6 uint32), mode, uid/gid (2 uint32) and
+	// size before the 20-byte hash.
+	aHashOff := 12 + 6*4 + 4 + 2*4 + 4
+	if got := hex.EncodeToString(data[aHashOff : aHashOff+20]); got != "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa" {
+		t.Fatalf("first entry hash = %s, want a.txt's hash", got)
+	}
+}
+
+// TestReaderFromDeltaRoundTrip reconstructs a target through the streaming
+// deltaReader path and checks it matches what applyDelta (the in-memory
+// path) produces from the same base/delta pair.
+func TestReaderFromDeltaRoundTrip(t *testing.T) {
+	base := []byte("hello world")
+	payload := buildCopyWholeBaseDelta(base, []byte("!"))
+
+	want, err := applyDelta(base, payload)
+	if err != nil {
+		t.Fatalf("applyDelta: %v", err)
+	}
+
+	r, err := ReaderFromDelta(NewBytesObjectReader(base), bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("ReaderFromDelta: %v", err)
+	}
+	defer r.Close()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("streamed content = %q, want %q", got, want)
+	}
+}
+
+// TestReaderFromDeltaRejectsOverrun feeds a delta whose instructions produce
+// more bytes than its own declared target size, which a corrupt or
+// mis-encoded delta could do, and checks deltaReader errors instead of
+// silently handing the caller more content than was declared.
+func TestReaderFromDeltaRejectsOverrun(t *testing.T) {
+	base := []byte("hello world")
+	payload := buildCopyWholeBaseDelta(base, []byte("!"))
+
+	// Replace the declared target size (the second varint) with one far
+	// smaller than the COPY instruction alone produces, so the very first
+	// instruction already overruns it.
+	srcSize, read, err := parseVarInt(payload)
+	if err != nil {
+		t.Fatalf("parseVarInt: %v", err)
+	}
+	_, read2, err := parseVarInt(payload[read:])
+	if err != nil {
+		t.Fatalf("parseVarInt: %v", err)
+	}
+	var buf bytes.Buffer
+	buf.Write(encodeDeltaVarint(srcSize))
+	buf.Write(encodeDeltaVarint(1))
+	buf.Write(payload[read+read2:])
+
+	r, err := ReaderFromDelta(NewBytesObjectReader(base), bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReaderFromDelta: %v", err)
+	}
+	defer r.Close()
+
+	if _, err := io.ReadAll(r); err == nil {
+		t.Fatal("expected an error when the delta overruns its declared target size")
+	}
+}
+
+// TestWriteObjectStreamRejectsSizeMismatch feeds writeObjectStream a reader
+// that yields fewer bytes than the declared size, which a corrupt pack or a
+// bug further up the streaming pipeline could cause, and checks it errors
+// instead of writing a loose object whose header size doesn't match its
+// content.
+func TestWriteObjectStreamRejectsSizeMismatch(t *testing.T) {
+	dir := t.TempDir()
+	origDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(origDir)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(".git/objects", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := writeObjectStream(bytes.NewReader([]byte("short")), "blob", 100); err == nil {
+		t.Fatal("expected an error when the reader yields fewer bytes than the declared size")
+	}
+}
+
+// TestWritePackIndexRoundTrip writes a v2 .idx for a handful of objects and
+// checks loadPackIndex/findOffset recover each one's pack offset (adjusted
+// for the 12-byte pack header writePackIndex accounts for) and CRC32.
+func TestWritePackIndexRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	origDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(origDir)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(".git/objects/pack", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	objects := []*PackObject{
+		{hash: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", offset: 0, crc32: 0x11111111},
+		{hash: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", offset: 100, crc32: 0x22222222},
+		{hash: "0123456789abcdef0123456789abcdef01234567", offset: 250, crc32: 0x33333333},
+	}
+	packHash := "cccccccccccccccccccccccccccccccccccccccc"
+
+	if err := writePackIndex(packHash, objects); err != nil {
+		t.Fatalf("writePackIndex: %v", err)
+	}
+
+	idxPath := filepath.Join(".git", "objects", "pack", fmt.Sprintf("pack-%s.idx", packHash))
+	pi, err := loadPackIndex(idxPath)
+	if err != nil {
+		t.Fatalf("loadPackIndex: %v", err)
+	}
+
+	const packHeaderLen = 12
+	for _, obj := range objects {
+		offset, ok := pi.findOffset(obj.hash)
+		if !ok {
+			t.Fatalf("findOffset(%s): not found", obj.hash)
+		}
+		if want := obj.offset + packHeaderLen; offset != want {
+			t.Fatalf("findOffset(%s) = %d, want %d", obj.hash, offset, want)
+		}
+	}
+
+	if _, ok := pi.findOffset("ffffffffffffffffffffffffffffffffffffffff"); ok {
+		t.Fatal("expected findOffset to miss on a hash not in the index")
+	}
+}
+
+// TestResolveDeltaObjectsOfsChain resolves a two-link ofs-delta chain
+// (base <- delta1 <- delta2) fed to resolveDeltaObjects in reverse pack
+// order, exercising the topological retry loop that lets a delta resolve
+// before its own base has appeared in the byOffset lookup.
+func TestResolveDeltaObjectsOfsChain(t *testing.T) {
+	origMode := StorageMode
+	StorageMode = "packed"
+	defer func() { StorageMode = origMode }()
+
+	base := []byte("hello")
+	mid := append(append([]byte{}, base...), []byte(" world")...)
+	final := append(append([]byte{}, mid...), []byte("!!")...)
+
+	baseObj := &PackObject{offset: 0, packType: OBJ_BLOB, objType: "blob", content: base}
+	delta1 := &PackObject{
+		offset: 100, packType: OBJ_OFS_DELTA, baseOffset: 0,
+		payload: buildCopyWholeBaseDelta(base, []byte(" world")),
+	}
+	delta2 := &PackObject{
+		offset: 200, packType: OBJ_OFS_DELTA, baseOffset: 100,
+		payload: buildCopyWholeBaseDelta(mid, []byte("!!")),
+	}
+
+	// Reverse pack order: delta2 and delta1 are pending before their base
+	// has a hash, so the first resolution pass must retry them.
+	objects := []*PackObject{delta2, delta1, baseObj}
+	if err := resolveDeltaObjects(objects); err != nil {
+		t.Fatalf("resolveDeltaObjects: %v", err)
+	}
+
+	if string(delta1.content) != string(mid) {
+		t.Fatalf("delta1.content = %q, want %q", delta1.content, mid)
+	}
+	if string(delta2.content) != string(final) {
+		t.Fatalf("delta2.content = %q, want %q", delta2.content, final)
+	}
+	if delta2.objType != "blob" {
+		t.Fatalf("delta2.objType = %q, want blob", delta2.objType)
+	}
+	if delta2.hash != hashContent(final, "blob") {
+		t.Fatalf("delta2.hash = %q, want %q", delta2.hash, hashContent(final, "blob"))
+	}
+}
+
+// BenchmarkResolveRefDeltasWithCache and BenchmarkResolveRefDeltasNoCache
+// show ObjectCache's effect on a pack where many ref-deltas share a base:
+// with the cache, only the first of numDeltas pays to read+decompress the
+// base from disk; without it (budget 0), every single one does.
+func BenchmarkResolveRefDeltasWithCache(b *testing.B) {
+	benchmarkResolveRefDeltas(b, DefaultObjectCacheBudget)
+}
+
+func BenchmarkResolveRefDeltasNoCache(b *testing.B) {
+	benchmarkResolveRefDeltas(b, 0)
+}